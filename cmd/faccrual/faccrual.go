@@ -1,71 +1,62 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
-)
-
-type OrderAccrual struct {
-	OrderID string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual,omitempty"`
-}
-
-func JSONSEncodeBytes(w io.Writer, val any) error {
-	enc := json.NewEncoder(w)
-	err := enc.Encode(val)
-	return err
-}
-
-func handleHTTP(res http.ResponseWriter, req *http.Request) {
-	id := req.PathValue("number")
-	log.Print("read order ", id)
 
-	var order OrderAccrual
-	order.OrderID = id
-
-	switch id[:1] {
-	case "1":
-		order.Status = "INVALID"
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/faccrual"
+	"go.uber.org/zap"
+)
 
-	default:
-		order.Status = "PROCESSED"
-		order.Accrual = 700
+func main() {
+	cfg, err := faccrual.GetConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	res.Header().Add("Content-Type", "application/json")
-
-	var buf bytes.Buffer
-	if errson := JSONSEncodeBytes(io.Writer(&buf), order); errson != nil {
-		log.Print("error encoding response ", errson)
-		res.WriteHeader(http.StatusInternalServerError)
-		return
+	l, err := logger.New(logger.Config{Level: cfg.Level})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	res.WriteHeader(http.StatusOK)
-
-	if _, err := io.WriteString(res, buf.String()); err != nil {
-		log.Print("error writing response", err)
-		res.WriteHeader(http.StatusInternalServerError)
-		return
-	} else {
-		fmt.Println(buf.String())
+	s := faccrual.New(cfg, l)
+	if cfg.Scenario != "" {
+		sc, err := faccrual.LoadScenario(cfg.Scenario)
+		if err != nil {
+			l.Logger.Fatal("load scenario", zap.Error(err))
+		}
+		if err := s.SetScenario(sc); err != nil {
+			l.Logger.Fatal("set scenario", zap.Error(err))
+		}
+	}
+	switch cfg.Mode {
+	case faccrual.ModeRecord:
+		f, err := os.OpenFile(cfg.RecordFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			l.Logger.Fatal("open record file", zap.Error(err))
+		}
+		defer f.Close()
+		rec, err := faccrual.NewRecorder(cfg.Upstream, f, l)
+		if err != nil {
+			l.Logger.Fatal("record", zap.Error(err))
+		}
+		s.UseAPI(rec)
+	case faccrual.ModeReplay:
+		rep, err := faccrual.LoadReplay(cfg.RecordFile)
+		if err != nil {
+			l.Logger.Fatal("load record file", zap.Error(err))
+		}
+		s.UseAPI(rep)
 	}
-}
-
-func main() {
-	http.HandleFunc("/api/orders/{number}", handleHTTP)
 	Srv := &http.Server{
-		Addr:              ":8100",
-		Handler:           nil,
+		Addr:              cfg.Address,
+		Handler:           s.Handler(),
 		ReadHeaderTimeout: 2 * time.Second,
 	}
+	l.Logger.Info("Start accrual simulator", zap.String("address", cfg.Address), zap.String("mode", cfg.Mode))
 	if err := Srv.ListenAndServe(); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		l.Logger.Fatal("ListenAndServe: ", zap.Error(err))
 	}
 }
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/4aleksei/gmart/internal/gophermart/app"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := app.RunMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "orders" {
+		if err := app.RunOrders(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	app.SetupFX().Run()
 }
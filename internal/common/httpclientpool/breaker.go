@@ -0,0 +1,189 @@
+package httpclientpool
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	StateClosed BreakerState = iota
+	StateOpen
+	StateHalfOpen
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+	defaultBreakerProbes   = 1
+)
+
+var ErrCircuitOpen = errors.New("accrual circuit breaker is open")
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type (
+	// Breaker stops requests to the accrual system after Failures failures
+	// in a row. After Cooldown it lets Probes requests through; if they all
+	// succeed the circuit closes, any failure opens it again.
+	Breaker struct {
+		mu        sync.Mutex
+		failures  int
+		cooldown  time.Duration
+		probes    int
+		state     BreakerState
+		count     int
+		inFlight  int
+		openedAt  time.Time
+		onChange  func(from, to BreakerState)
+		openTotal int64
+	}
+
+	BreakerStats struct {
+		State     string    `json:"state"`
+		OpenedAt  time.Time `json:"opened_at"`
+		RetryAt   time.Time `json:"retry_at"`
+		Failures  int       `json:"failures"`
+		OpenTotal int64     `json:"open_total"`
+	}
+)
+
+func NewBreaker(failures int, cooldown time.Duration, probes int) *Breaker {
+	if failures < 1 {
+		failures = defaultBreakerFailures
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	if probes < 1 {
+		probes = defaultBreakerProbes
+	}
+	return &Breaker{
+		failures: failures,
+		cooldown: cooldown,
+		probes:   probes,
+	}
+}
+
+// OnChange sets a callback called on every state change under the breaker lock.
+func (b *Breaker) OnChange(fn func(from, to BreakerState)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+func (b *Breaker) setState(to BreakerState, now time.Time) {
+	from := b.state
+	b.state = to
+	b.count = 0
+	b.inFlight = 0
+	if to == StateOpen {
+		b.openedAt = now
+		b.openTotal++
+	}
+	if b.onChange != nil && from != to {
+		b.onChange(from, to)
+	}
+}
+
+// Allow reports whether a request may be sent. Every allowed request must
+// be followed by Success or Failure.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(StateHalfOpen, now)
+		fallthrough
+	case StateHalfOpen:
+		if b.inFlight >= b.probes {
+			return ErrCircuitOpen
+		}
+		b.inFlight++
+	}
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateClosed:
+		b.count = 0
+	case StateHalfOpen:
+		b.count++
+		if b.count >= b.probes {
+			b.setState(StateClosed, time.Now())
+		}
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateClosed:
+		b.count++
+		if b.count >= b.failures {
+			b.setState(StateOpen, time.Now())
+		}
+	case StateHalfOpen:
+		b.setState(StateOpen, time.Now())
+	}
+}
+
+// Cancel returns the slot of an allowed request that was not sent.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen && b.inFlight > 0 {
+		b.inFlight--
+	}
+}
+
+// State returns the current state and, for an open circuit, when probing starts.
+func (b *Breaker) State() (BreakerState, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen {
+		return b.state, b.openedAt.Add(b.cooldown)
+	}
+	return b.state, time.Time{}
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStats{
+		State:     b.state.String(),
+		OpenedAt:  b.openedAt,
+		OpenTotal: b.openTotal,
+	}
+	if b.state == StateClosed {
+		st.Failures = b.count
+	}
+	if b.state == StateOpen {
+		st.RetryAt = b.openedAt.Add(b.cooldown)
+	}
+	return st
+}
@@ -0,0 +1,45 @@
+package httpclientpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(3, 20*time.Millisecond, 1)
+	var changes []string
+	b.OnChange(func(from, to BreakerState) { changes = append(changes, from.String()+">"+to.String()) })
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.Allow())
+		b.Failure()
+	}
+	require.NoError(t, b.Allow())
+	b.Success()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Allow())
+		b.Failure()
+	}
+	st, retryAt := b.State()
+	assert.Equal(t, StateOpen, st)
+	assert.False(t, retryAt.IsZero())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	time.Sleep(25 * time.Millisecond)
+	require.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen, "only one probe in half-open")
+	b.Failure()
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	time.Sleep(25 * time.Millisecond)
+	require.NoError(t, b.Allow())
+	b.Success()
+	st, _ = b.State()
+	assert.Equal(t, StateClosed, st)
+
+	assert.Equal(t, []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}, changes)
+	assert.Equal(t, int64(2), b.Stats().OpenTotal)
+}
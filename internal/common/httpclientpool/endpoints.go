@@ -0,0 +1,204 @@
+package httpclientpool
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProbeInterval = 5 * time.Second
+	defaultProbeTimeout  = 2 * time.Second
+	probePath            = "/api/orders/0"
+)
+
+type (
+	// Endpoint is one accrual system address. It is taken out of rotation
+	// on a connection error and put back by the next successful probe.
+	Endpoint struct {
+		URL string
+
+		healthy  atomic.Bool
+		requests atomic.Int64
+		failures atomic.Int64
+		failover atomic.Int64
+
+		mu        sync.Mutex
+		lastError string
+		lastProbe time.Time
+	}
+
+	EndpointStats struct {
+		URL       string    `json:"url"`
+		Healthy   bool      `json:"healthy"`
+		Requests  int64     `json:"requests"`
+		Failures  int64     `json:"failures"`
+		Failover  int64     `json:"failover"`
+		LastError string    `json:"last_error,omitempty"`
+		LastProbe time.Time `json:"last_probe"`
+	}
+
+	// Endpoints spreads requests over the healthy endpoints round robin and
+	// probes all of them in the background.
+	Endpoints struct {
+		list   []*Endpoint
+		next   atomic.Uint64
+		client *http.Client
+		l      *logger.ZapLogger
+		wg     sync.WaitGroup
+		cancel context.CancelFunc
+	}
+)
+
+// ParseEndpoints splits a comma separated list of addresses; an address
+// without scheme gets http://.
+func ParseEndpoints(addresses string) []string {
+	res := make([]string, 0)
+	for _, a := range strings.Split(addresses, ",") {
+		a = strings.TrimRight(strings.TrimSpace(a), "/")
+		if a == "" {
+			continue
+		}
+		if !strings.Contains(a, "://") {
+			a = "http://" + a
+		}
+		res = append(res, a)
+	}
+	return res
+}
+
+func NewEndpoints(urls []string, l *logger.ZapLogger) *Endpoints {
+	e := &Endpoints{
+		list:   make([]*Endpoint, len(urls)),
+		client: newClient(),
+		l:      l,
+	}
+	for i, u := range urls {
+		e.list[i] = &Endpoint{URL: u}
+		e.list[i].healthy.Store(true)
+	}
+	return e
+}
+
+// Pick returns the next healthy endpoint other than skip. When no endpoint
+// is healthy it still returns one, so requests are not blocked by probes.
+func (e *Endpoints) Pick(skip *Endpoint) *Endpoint {
+	n := len(e.list)
+	if n == 0 {
+		return nil
+	}
+	start := e.next.Add(1)
+	for i := 0; i < n; i++ {
+		ep := e.list[(start+uint64(i))%uint64(n)]
+		if ep != skip && ep.healthy.Load() {
+			return ep
+		}
+	}
+	if skip != nil {
+		return nil
+	}
+	return e.list[start%uint64(n)]
+}
+
+// Failure takes the endpoint out of rotation after a connection error.
+func (e *Endpoints) Failure(ep *Endpoint, err error) {
+	ep.failures.Add(1)
+	ep.mu.Lock()
+	ep.lastError = err.Error()
+	ep.mu.Unlock()
+	if ep.healthy.CompareAndSwap(true, false) {
+		e.l.Logger.Warn("accrual endpoint is down", zap.String("url", ep.URL), zap.Error(err))
+	}
+}
+
+func (e *Endpoints) probe(ctx context.Context, ep *Endpoint) {
+	ctxProbe, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+
+	healthy := false
+	var errText string
+	req, err := http.NewRequestWithContext(ctxProbe, http.MethodGet, ep.URL+probePath, http.NoBody)
+	if err == nil {
+		var resp *http.Response
+		resp, err = e.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode < http.StatusInternalServerError
+			if !healthy {
+				errText = resp.Status
+			}
+		}
+	}
+	if err != nil {
+		errText = err.Error()
+	}
+
+	ep.mu.Lock()
+	ep.lastProbe = time.Now()
+	if errText != "" {
+		ep.lastError = errText
+	}
+	ep.mu.Unlock()
+
+	if ep.healthy.Swap(healthy) != healthy {
+		if healthy {
+			e.l.Logger.Info("accrual endpoint is up", zap.String("url", ep.URL))
+		} else {
+			e.l.Logger.Warn("accrual endpoint is down", zap.String("url", ep.URL), zap.String("error", errText))
+		}
+	}
+}
+
+func (e *Endpoints) Start(ctx context.Context) error {
+	ctxCancel, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(defaultProbeInterval)
+		defer ticker.Stop()
+		for {
+			for _, ep := range e.list {
+				e.probe(ctxCancel, ep)
+			}
+			select {
+			case <-ctxCancel.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *Endpoints) Stop(ctx context.Context) error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.wg.Wait()
+	return nil
+}
+
+func (e *Endpoints) Stats() []EndpointStats {
+	res := make([]EndpointStats, len(e.list))
+	for i, ep := range e.list {
+		ep.mu.Lock()
+		res[i] = EndpointStats{
+			URL:       ep.URL,
+			Healthy:   ep.healthy.Load(),
+			Requests:  ep.requests.Load(),
+			Failures:  ep.failures.Load(),
+			Failover:  ep.failover.Load(),
+			LastError: ep.lastError,
+			LastProbe: ep.lastProbe,
+		}
+		ep.mu.Unlock()
+	}
+	return res
+}
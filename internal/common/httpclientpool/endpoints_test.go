@@ -0,0 +1,55 @@
+package httpclientpool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	assert.Equal(t, []string{"http://localhost:8100", "https://b.example.com"},
+		ParseEndpoints(" localhost:8100/ ,, https://b.example.com"))
+	assert.Empty(t, ParseEndpoints(""))
+}
+
+func TestEndpoints_Failover(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order":"2377225624","status":"PROCESSED","accrual":500}`))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	pr := NewProvider(DefaultProvider, downURL+","+up.URL, 0, 1, l)
+	eps := pr.Endpoints
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		res, err := sendWithFailover(ctx, newClient(), pr, "2377225624", l)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.status)
+	}
+
+	st := eps.Stats()
+	assert.False(t, st[0].Healthy)
+	assert.Equal(t, int64(1), st[0].Failures)
+	assert.NotEmpty(t, st[0].LastError)
+	assert.True(t, st[1].Healthy)
+	assert.Equal(t, int64(4), st[1].Requests)
+
+	eps.probe(ctx, eps.list[0])
+	eps.probe(ctx, eps.list[1])
+	st = eps.Stats()
+	assert.False(t, st[0].Healthy)
+	assert.True(t, st[1].Healthy)
+	assert.False(t, st[1].LastProbe.IsZero())
+}
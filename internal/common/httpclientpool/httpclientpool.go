@@ -1,12 +1,13 @@
 package httpclientpool
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 
 	"net/http"
-	"sync"
 
 	"net"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"strconv"
 
 	"github.com/4aleksei/gmart/internal/common/models"
+	"github.com/4aleksei/gmart/internal/common/store"
 	"go.uber.org/zap"
 )
 
@@ -28,8 +30,11 @@ const (
 )
 
 const (
-	HTTPRetryCode   int = 429
-	HTTPSuccessCode int = 200
+	HTTPRetryCode     int = 429
+	HTTPSuccessCode   int = 200
+	HTTPNoContentCode int = 204
+
+	maxAccrualBody int64 = 64 << 10
 )
 
 var (
@@ -38,32 +43,48 @@ var (
 
 	ErrJSONDecode = errors.New("cannot decode resp JSON body")
 	ErrBadValue   = errors.New("orderID bad value")
+
+	ErrNotRegistered    = errors.New("order not registered in accrual")
+	ErrServerError      = errors.New("accrual server error")
+	ErrUnexpectedStatus = errors.New("unexpected accrual status code")
+	ErrNoEndpoints      = errors.New("no accrual endpoints")
 )
 
 type (
 	Config struct {
 		RateLimit uint64
 		Address   string
+		Router    *Router
 	}
 
+	// PoolHandler polls the accrual providers for orders.
 	PoolHandler struct {
 		WorkerCount int
-		clients     []clientInstance
+		pool        *Pool[store.Order, OrderResult]
 		cfg         Config
 		l           *logger.ZapLogger
 	}
-	functioExec func(context.Context, *sync.WaitGroup, *http.Client,
-		<-chan job.Job, chan<- job.Result, *Config, *logger.ZapLogger)
-	clientInstance struct {
-		execFn functioExec
-		client *http.Client
-		cfg    *Config
+
+	// OrderResult is the answer of the accrual system for one order. Order
+	// carries the new status and accrual and the provider asked, Code and
+	// WaitSec the HTTP status and Retry-After, Raw the body as received.
+	OrderResult struct {
+		Order   store.Order
+		Code    int
+		WaitSec int
+		Raw     []byte
+	}
+
+	accrualExecutor struct {
+		cfg *Config
+		l   *logger.ZapLogger
 	}
 
 	resulAccrual struct {
 		status   int
 		waitTime int
 		value    models.OrderAccrual
+		raw      []byte
 		err      error
 	}
 )
@@ -72,24 +93,80 @@ func NewHandler(l *logger.ZapLogger) *PoolHandler {
 	return &PoolHandler{l: l}
 }
 
+// SetCfgInit sets the number of workers and the address of the default
+// accrual provider, a comma separated list for several endpoints.
 func (p *PoolHandler) SetCfgInit(r uint64, a string) {
+	p.WorkerCount = int(r)
 	p.cfg = Config{
 		RateLimit: r,
 		Address:   a,
+		Router:    NewRouter(NewProvider(DefaultProvider, a, 0, p.WorkerCount, p.l)),
 	}
-	p.WorkerCount = int(r)
-	p.clients = make([]clientInstance, p.WorkerCount)
-	for i := 0; i < p.WorkerCount; i++ {
-		p.clients[i] = *newClientInstance(&p.cfg)
+	p.pool = NewPool[store.Order, OrderResult](p.WorkerCount, &accrualExecutor{cfg: &p.cfg, l: p.l}, p.l)
+}
+
+// SetRequestRate limits the default provider to rps requests per second.
+func (p *PoolHandler) SetRequestRate(rps float64) {
+	p.cfg.Router.Default().Limiter = NewLimiter(rps, p.WorkerCount)
+}
+
+// SetBreaker replaces the circuit breaker of the default provider.
+func (p *PoolHandler) SetBreaker(failures int, cooldown time.Duration, probes int) {
+	p.cfg.Router.Default().SetBreaker(failures, cooldown, probes, p.l)
+}
+
+// SetRouting adds providers and routing rules to the default provider.
+func (p *PoolHandler) SetRouting(rc *RoutingConfig) error {
+	return p.cfg.Router.Apply(rc, p.WorkerCount, p.l)
+}
+
+// BreakerState returns the open state only when the circuits of all
+// providers are open, with the earliest time one of them is probed again.
+func (p *PoolHandler) BreakerState() (BreakerState, time.Time) {
+	var retryAt time.Time
+	for _, pr := range p.cfg.Router.Providers() {
+		st, at := pr.Breaker.State()
+		if st != StateOpen {
+			return st, time.Time{}
+		}
+		if retryAt.IsZero() || at.Before(retryAt) {
+			retryAt = at
+		}
+	}
+	return StateOpen, retryAt
+}
+
+func (p *PoolHandler) LimiterStats() map[string]LimiterStats {
+	res := make(map[string]LimiterStats)
+	for _, pr := range p.cfg.Router.Providers() {
+		res[pr.Name] = pr.Limiter.Stats()
+	}
+	return res
+}
+
+func (p *PoolHandler) BreakerStats() map[string]BreakerStats {
+	res := make(map[string]BreakerStats)
+	for _, pr := range p.cfg.Router.Providers() {
+		res[pr.Name] = pr.Breaker.Stats()
 	}
+	return res
 }
 
-func newClientInstance(cfg *Config) *clientInstance {
-	return &clientInstance{
-		execFn: workerPlain,
-		client: newClient(),
-		cfg:    cfg,
+func (p *PoolHandler) EndpointStats() map[string][]EndpointStats {
+	res := make(map[string][]EndpointStats)
+	for _, pr := range p.cfg.Router.Providers() {
+		res[pr.Name] = pr.Endpoints.Stats()
 	}
+	return res
+}
+
+// Start runs health probes of the accrual endpoints.
+func (p *PoolHandler) Start(ctx context.Context) error {
+	return p.cfg.Router.Start(ctx)
+}
+
+func (p *PoolHandler) Stop(ctx context.Context) error {
+	return p.cfg.Router.Stop(ctx)
 }
 
 func newClient() *http.Client {
@@ -104,52 +181,96 @@ func newClient() *http.Client {
 	}
 }
 
-func workerPlain(ctx context.Context, wg *sync.WaitGroup, client *http.Client,
-	jobs <-chan job.Job, results chan<- job.Result, cfg *Config, l *logger.ZapLogger) {
-	defer wg.Done()
-	server := cfg.Address + "/api/orders/"
-	for j := range jobs {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			data := strconv.FormatUint(j.Value.OrderID, 10)
-			resClient, err := plainTxtFunc(ctx, client, server, data, l)
-			if err != nil && errors.Is(err, context.Canceled) {
-				return
-			}
-
-			var res = job.Result{
-				Value: j.Value,
-				Err:   err,
-				ID:    j.ID,
-			}
-
-			if resClient != nil {
-				res.Result = resClient.status
-				res.WaitSec = resClient.waitTime
-				res.Value.Accrual = resClient.value.Accrual
-				res.Value.Status = resClient.value.Status
-			}
-			results <- res
-		}
+// StreamOrders polls the accrual system for the orders and streams one
+// result per order, see Pool.Stream.
+func (p *PoolHandler) StreamOrders(ctx context.Context, orders []store.Order) <-chan job.Result[OrderResult] {
+	return p.pool.Stream(ctx, orders)
+}
+
+// Execute asks the provider routed for the order about its status. The
+// order goes through the provider's limiter and circuit breaker, and a
+// response failing validation gives an ErrAnomaly error.
+func (e *accrualExecutor) Execute(ctx context.Context, client *http.Client, j job.Job[store.Order]) (OrderResult, error) {
+	cfg, l := e.cfg, e.l
+	pr := cfg.Router.Route(j.Value)
+	res := OrderResult{Order: j.Value}
+	res.Order.Provider = pr.Name
+	if err := pr.Limiter.Wait(ctx); err != nil {
+		return res, err
 	}
+	if err := pr.Breaker.Allow(); err != nil {
+		return res, err
+	}
+	data := strconv.FormatUint(j.Value.OrderID, 10)
+	resClient, err := sendWithFailover(ctx, client, pr, data, l)
+	if err != nil && errors.Is(err, context.Canceled) {
+		pr.Breaker.Cancel()
+		return res, err
+	}
+	if err != nil || (resClient != nil && resClient.status >= http.StatusInternalServerError) {
+		pr.Breaker.Failure()
+	} else {
+		pr.Breaker.Success()
+	}
+	if resClient == nil {
+		return res, err
+	}
+	if resClient.status == HTTPRetryCode {
+		pr.Limiter.Pause(time.Duration(resClient.waitTime) * time.Second)
+		l.Logger.Debug("accrual asks to retry, pause workers", zap.String("provider", pr.Name),
+			zap.Int("retry after", resClient.waitTime), zap.Float64("rate", pr.Limiter.Stats().Rate))
+	}
+
+	res.Code = resClient.status
+	res.WaitSec = resClient.waitTime
+	res.Raw = resClient.raw
+	err = resClient.err
+	if err == nil && res.Code == HTTPSuccessCode {
+		err = ValidateAccrual(data, resClient.value)
+	}
+	if err == nil {
+		res.Order.Accrual = resClient.value.Accrual
+		res.Order.Status = resClient.value.Status
+	}
+	return res, err
 }
 
-func (p *PoolHandler) StartPool(ctx context.Context, jobs chan job.Job, results chan job.Result, wg *sync.WaitGroup) {
-	for i := 0; i < p.WorkerCount; i++ {
-		wg.Add(1)
-		go p.clients[i].execFn(ctx, wg, p.clients[i].client, jobs, results, &p.cfg, p.l)
+// sendWithFailover sends the request to a healthy endpoint of the provider
+// and, on a connection error, once more to another one.
+func sendWithFailover(ctx context.Context, client *http.Client, pr *Provider, data string, l *logger.ZapLogger) (*resulAccrual, error) {
+	eps := pr.Endpoints
+	ep := eps.Pick(nil)
+	if ep == nil {
+		return nil, ErrNoEndpoints
+	}
+	ep.requests.Add(1)
+	res, err := plainTxtFunc(ctx, client, ep.URL+"/api/orders/", data, pr.header, l)
+	if err == nil || ctx.Err() != nil {
+		return res, err
+	}
+	eps.Failure(ep, err)
+
+	alt := eps.Pick(ep)
+	if alt == nil {
+		return res, err
 	}
+	alt.requests.Add(1)
+	alt.failover.Add(1)
+	l.Logger.Debug("failover", zap.String("from", ep.URL), zap.String("to", alt.URL))
+	res, err = plainTxtFunc(ctx, client, alt.URL+"/api/orders/", data, pr.header, l)
+	if err != nil && ctx.Err() == nil {
+		eps.Failure(alt, err)
+	}
+	return res, err
 }
 
-func plainTxtFunc(ctx context.Context, client *http.Client, server, data string, l *logger.ZapLogger) (*resulAccrual, error) {
-	res, err := newPGetReq(ctx, client, server+data, http.NoBody, l)
+func plainTxtFunc(ctx context.Context, client *http.Client, server, data string, header http.Header, l *logger.ZapLogger) (*resulAccrual, error) {
+	res, err := newPGetReq(ctx, client, server+data, http.NoBody, header, l)
 	return res, err
 }
 
 func newPGetReq(ctx context.Context, client *http.Client,
-	server string, requestBody io.Reader, l *logger.ZapLogger) (*resulAccrual, error) {
+	server string, requestBody io.Reader, header http.Header, l *logger.ZapLogger) (*resulAccrual, error) {
 	l.Logger.Debug("request ", zap.String("url ", server))
 
 	req, err := http.NewRequestWithContext(ctx, "GET", server, requestBody)
@@ -157,6 +278,9 @@ func newPGetReq(ctx context.Context, client *http.Client,
 		l.Logger.Debug("make req error ", zap.Error(err))
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Content-Type", textPlainContent)
 	req.Header.Set("Accept", applicationJSONContent)
 
@@ -172,16 +296,27 @@ func newPGetReq(ctx context.Context, client *http.Client,
 
 	l.Logger.Debug("status ", zap.Int("new status", resp.StatusCode))
 
-	if resp.StatusCode == HTTPRetryCode {
+	switch {
+	case resp.StatusCode == HTTPRetryCode:
 		if resp.Header.Get("Retry-After") != "" {
 			result.waitTime, _ = strconv.Atoi(resp.Header.Get("Retry-After"))
 		}
-	} else if resp.StatusCode == HTTPSuccessCode {
-		err = result.value.FromJSON(resp.Body)
+	case resp.StatusCode == HTTPSuccessCode:
+		result.raw, err = io.ReadAll(io.LimitReader(resp.Body, maxAccrualBody))
+		if err != nil {
+			return nil, err
+		}
+		err = result.value.FromJSON(io.NopCloser(bytes.NewReader(result.raw)))
 		if err != nil {
-			result.err = ErrJSONDecode
+			result.err = fmt.Errorf("%w: %w", ErrJSONDecode, err)
 		}
 		l.Logger.Debug("result ", zap.Any("order", result.value))
+	case resp.StatusCode == HTTPNoContentCode:
+		result.err = ErrNotRegistered
+	case resp.StatusCode >= http.StatusInternalServerError:
+		result.err = fmt.Errorf("%w: %d", ErrServerError, resp.StatusCode)
+	default:
+		result.err = fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
 	}
 	return result, nil
 }
@@ -0,0 +1,56 @@
+package httpclientpool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newPGetReq(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		header  map[string]string
+		wantErr error
+		wait    int
+	}{
+		{name: "processed", status: http.StatusOK, body: `{"order":"2377225624","status":"PROCESSED","accrual":500}`},
+		{name: "bad json", status: http.StatusOK, body: `{"order":"2377225624","status":`, wantErr: ErrJSONDecode},
+		{name: "not registered", status: http.StatusNoContent, wantErr: ErrNotRegistered},
+		{name: "too many requests", status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "60"}, wait: 60},
+		{name: "server error", status: http.StatusBadGateway, wantErr: ErrServerError},
+		{name: "unexpected", status: http.StatusNotFound, wantErr: ErrUnexpectedStatus},
+	}
+
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			res, err := newPGetReq(context.Background(), ts.Client(), ts.URL+"/api/orders/2377225624", http.NoBody, nil, l)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, res.status)
+			assert.Equal(t, tt.wait, res.waitTime)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, res.err, tt.wantErr)
+			} else {
+				assert.NoError(t, res.err)
+			}
+		})
+	}
+}
@@ -1,22 +1,20 @@
 package job
 
-import (
-	"github.com/4aleksei/gmart/internal/common/store"
-)
-
 type (
-	JobID  uint64
-	Result struct {
-		ID      JobID
-		Result  int
-		WaitSec int
-		Value   store.Order
-		Err     error
+	JobID uint64
+
+	// Job is one unit of work of type J sent to a pool.
+	Job[J any] struct {
+		ID    JobID
+		Value J
 	}
 
-	Job struct {
+	// Result is the outcome of the job with the same ID. Value may be set
+	// together with Err.
+	Result[R any] struct {
 		ID    JobID
-		Value store.Order
+		Value R
+		Err   error
 	}
 	JobDone struct{}
 )
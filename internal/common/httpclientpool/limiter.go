@@ -0,0 +1,135 @@
+package httpclientpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRampUp      = 30 * time.Second
+	defaultRetryPause  = time.Second
+	minRateFraction    = 0.1
+	rateDecreaseFactor = 0.5
+)
+
+type (
+	// Limiter is a token bucket shared by all workers of a pool. A Retry-After
+	// from the accrual system pauses every worker, halves the rate and then
+	// lets it grow back linearly to the configured one.
+	Limiter struct {
+		mu          sync.Mutex
+		maxRate     float64
+		minRate     float64
+		rate        float64
+		rampPerSec  float64
+		burst       float64
+		tokens      float64
+		last        time.Time
+		pausedUntil time.Time
+
+		requests atomic.Int64
+		pauses   atomic.Int64
+	}
+
+	LimiterStats struct {
+		MaxRate     float64   `json:"max_rate"`
+		Rate        float64   `json:"rate"`
+		PausedUntil time.Time `json:"paused_until"`
+		Requests    int64     `json:"requests"`
+		Pauses      int64     `json:"pauses"`
+	}
+)
+
+// NewLimiter returns a limiter for rate requests per second.
+// A non positive rate means no limit, only pauses are applied.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &Limiter{
+		maxRate: rate,
+		minRate: rate * minRateFraction,
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+	l.rampPerSec = (rate - l.minRate) / defaultRampUp.Seconds()
+	return l
+}
+
+// Wait blocks until a request may be sent or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		d := l.reserve(time.Now())
+		if d <= 0 {
+			l.requests.Add(1)
+			return nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// reserve takes a token and returns zero, or returns how long to wait
+// before trying again.
+func (l *Limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.maxRate <= 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if l.rate < l.maxRate {
+		l.rate = min(l.maxRate, l.rate+l.rampPerSec*elapsed)
+	}
+	l.tokens = min(l.burst, l.tokens+l.rate*elapsed)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Pause stops all workers for d and lowers the rate.
+func (l *Limiter) Pause(d time.Duration) {
+	if d <= 0 {
+		d = defaultRetryPause
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if until := now.Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.rate = max(l.minRate, l.rate*rateDecreaseFactor)
+	l.tokens = 0
+	l.last = l.pausedUntil
+	l.pauses.Add(1)
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LimiterStats{
+		MaxRate:     l.maxRate,
+		Rate:        l.rate,
+		PausedUntil: l.pausedUntil,
+		Requests:    l.requests.Load(),
+		Pauses:      l.pauses.Load(),
+	}
+}
@@ -0,0 +1,51 @@
+package httpclientpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Rate(t *testing.T) {
+	l := NewLimiter(100, 1)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		require.NoError(t, l.Wait(ctx))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.Equal(t, int64(11), l.Stats().Requests)
+}
+
+func TestLimiter_PauseAndRamp(t *testing.T) {
+	l := NewLimiter(100, 1)
+	ctx := context.Background()
+
+	l.Pause(50 * time.Millisecond)
+	st := l.Stats()
+	assert.Equal(t, int64(1), st.Pauses)
+	assert.InDelta(t, 50, st.Rate, 0.001)
+
+	start := time.Now()
+	require.NoError(t, l.Wait(ctx))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	l.mu.Lock()
+	l.last = l.last.Add(-defaultRampUp)
+	l.mu.Unlock()
+	require.NoError(t, l.Wait(ctx))
+	assert.InDelta(t, 100, l.Stats().Rate, 0.001)
+}
+
+func TestLimiter_Cancel(t *testing.T) {
+	l := NewLimiter(0, 1)
+	l.Pause(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
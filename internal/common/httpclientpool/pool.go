@@ -0,0 +1,110 @@
+package httpclientpool
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/4aleksei/gmart/internal/common/httpclientpool/job"
+	"github.com/4aleksei/gmart/internal/common/logger"
+)
+
+type (
+	// Executor runs one job with the http client of a worker. A worker
+	// stops without sending the result once ctx is done.
+	Executor[J, R any] interface {
+		Execute(ctx context.Context, client *http.Client, j job.Job[J]) (R, error)
+	}
+
+	ExecutorFunc[J, R any] func(ctx context.Context, client *http.Client, j job.Job[J]) (R, error)
+
+	// Pool runs jobs of type J on a fixed number of workers, each with its
+	// own http client, and returns results of type R. An optional Limiter
+	// caps the request rate of all workers.
+	Pool[J, R any] struct {
+		WorkerCount int
+		Limiter     *Limiter
+		exec        Executor[J, R]
+		clients     []*http.Client
+		jid         atomic.Uint64
+		l           *logger.ZapLogger
+	}
+)
+
+func (f ExecutorFunc[J, R]) Execute(ctx context.Context, client *http.Client, j job.Job[J]) (R, error) {
+	return f(ctx, client, j)
+}
+
+func NewPool[J, R any](workers int, exec Executor[J, R], l *logger.ZapLogger) *Pool[J, R] {
+	p := &Pool[J, R]{
+		WorkerCount: max(workers, 1),
+		exec:        exec,
+		l:           l,
+	}
+	p.clients = make([]*http.Client, p.WorkerCount)
+	for i := range p.clients {
+		p.clients[i] = newClient()
+	}
+	return p
+}
+
+// StartPool starts the workers reading jobs until the channel is closed or
+// ctx is done. Each finished worker calls wg.Done.
+func (p *Pool[J, R]) StartPool(ctx context.Context, jobs <-chan job.Job[J], results chan<- job.Result[R], wg *sync.WaitGroup) {
+	for i := 0; i < p.WorkerCount; i++ {
+		wg.Add(1)
+		go p.worker(ctx, wg, p.clients[i], jobs, results)
+	}
+}
+
+func (p *Pool[J, R]) worker(ctx context.Context, wg *sync.WaitGroup, client *http.Client,
+	jobs <-chan job.Job[J], results chan<- job.Result[R]) {
+	defer wg.Done()
+	for j := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		if p.Limiter != nil {
+			if err := p.Limiter.Wait(ctx); err != nil {
+				return
+			}
+		}
+		v, err := p.exec.Execute(ctx, client, j)
+		if ctx.Err() != nil {
+			return
+		}
+		results <- job.Result[R]{ID: j.ID, Value: v, Err: err}
+	}
+}
+
+// Stream runs a job for every value and streams the results as soon as
+// they are ready. The channel is bounded, so a slow reader holds the
+// workers back. It is closed when all workers are done; the reader has to
+// drain it even after ctx is cancelled.
+func (p *Pool[J, R]) Stream(ctx context.Context, values []J) <-chan job.Result[R] {
+	wg := &sync.WaitGroup{}
+	jobs := make(chan job.Job[J], p.WorkerCount*2)
+	results := make(chan job.Result[R], p.WorkerCount*2)
+
+	go p.send(ctx, jobs, values)
+
+	p.StartPool(ctx, jobs, results, wg)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+func (p *Pool[J, R]) send(ctx context.Context, jobs chan<- job.Job[J], values []J) {
+	defer close(jobs)
+	for _, v := range values {
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- job.Job[J]{ID: job.JobID(p.jid.Add(1)), Value: v}:
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package httpclientpool
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/4aleksei/gmart/internal/common/httpclientpool/job"
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Stream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(strings.ToUpper(string(body))))
+	}))
+	defer ts.Close()
+
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	exec := ExecutorFunc[string, string](func(ctx context.Context, client *http.Client, j job.Job[string]) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL, strings.NewReader(j.Value))
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	})
+	p := NewPool[string, string](3, exec, l)
+	p.Limiter = NewLimiter(1000, 3)
+
+	values := []string{"a", "b", "c", "d", "e"}
+	got := make(map[string]bool)
+	ids := make(map[job.JobID]bool)
+	for res := range p.Stream(context.Background(), values) {
+		require.NoError(t, res.Err)
+		got[res.Value] = true
+		ids[res.ID] = true
+	}
+	assert.Len(t, got, len(values))
+	assert.True(t, got["E"])
+	assert.Len(t, ids, len(values))
+	assert.Equal(t, int64(len(values)), p.Limiter.Stats().Requests)
+}
+
+func TestPool_StreamCancel(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exec := ExecutorFunc[int, int](func(ctx context.Context, client *http.Client, j job.Job[int]) (int, error) {
+		if j.Value == 2 {
+			cancel()
+		}
+		return j.Value, ctx.Err()
+	})
+	p := NewPool[int, int](1, exec, l)
+
+	var n int
+	for range p.Stream(ctx, []int{1, 2, 3, 4}) {
+		n++
+	}
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,226 @@
+package httpclientpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/store"
+	"go.uber.org/zap"
+)
+
+const DefaultProvider = "default"
+
+var (
+	ErrUnknownProvider   = errors.New("unknown accrual provider")
+	ErrDuplicateProvider = errors.New("duplicate accrual provider")
+	ErrBadRule           = errors.New("accrual rule needs prefix or group")
+)
+
+type (
+	// Provider is one accrual system with its own endpoints, rate limit,
+	// circuit breaker and credentials.
+	Provider struct {
+		Name      string
+		Endpoints *Endpoints
+		Limiter   *Limiter
+		Breaker   *Breaker
+		header    http.Header
+	}
+
+	ProviderConfig struct {
+		Name               string  `json:"name"`
+		Address            string  `json:"address"`
+		RPS                float64 `json:"rps"`
+		Token              string  `json:"token"`
+		User               string  `json:"user"`
+		Password           string  `json:"password"`
+		BreakerFailures    int     `json:"breaker_failures"`
+		BreakerCooldownSec int     `json:"breaker_cooldown"`
+	}
+
+	// RuleConfig routes orders whose number starts with Prefix and whose
+	// user is in Group to Provider; an empty field matches any order.
+	// Rules are checked in order.
+	RuleConfig struct {
+		Prefix   string `json:"prefix"`
+		Group    string `json:"group"`
+		Provider string `json:"provider"`
+	}
+
+	RoutingConfig struct {
+		Providers []ProviderConfig    `json:"providers"`
+		Rules     []RuleConfig        `json:"rules"`
+		Groups    map[string][]uint64 `json:"groups"`
+		Default   string              `json:"default"`
+	}
+
+	rule struct {
+		prefix   string
+		users    map[uint64]struct{}
+		provider *Provider
+	}
+
+	// Router chooses the provider of an order.
+	Router struct {
+		providers []*Provider
+		rules     []rule
+		def       *Provider
+	}
+)
+
+func NewProvider(name, address string, rps float64, workers int, l *logger.ZapLogger) *Provider {
+	p := &Provider{
+		Name:      name,
+		Endpoints: NewEndpoints(ParseEndpoints(address), l),
+		Limiter:   NewLimiter(rps, workers),
+		header:    make(http.Header),
+	}
+	p.SetBreaker(defaultBreakerFailures, defaultBreakerCooldown, defaultBreakerProbes, l)
+	return p
+}
+
+// SetBreaker replaces the circuit breaker of the provider; state changes are logged.
+func (p *Provider) SetBreaker(failures int, cooldown time.Duration, probes int, l *logger.ZapLogger) {
+	p.Breaker = NewBreaker(failures, cooldown, probes)
+	p.Breaker.OnChange(func(from, to BreakerState) {
+		l.Logger.Warn("accrual circuit breaker", zap.String("provider", p.Name),
+			zap.Stringer("from", from), zap.Stringer("to", to))
+	})
+}
+
+// SetAuth sets a bearer token or, without it, basic credentials sent
+// with every request.
+func (p *Provider) SetAuth(token, user, password string) {
+	switch {
+	case token != "":
+		p.header.Set("Authorization", "Bearer "+token)
+	case user != "":
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(user, password)
+		p.header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+}
+
+func LoadRouting(path string) (*RoutingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rc := new(RoutingConfig)
+	if err := json.Unmarshal(data, rc); err != nil {
+		return nil, fmt.Errorf("accrual providers %s: %w", path, err)
+	}
+	return rc, nil
+}
+
+func NewRouter(def *Provider) *Router {
+	return &Router{
+		providers: []*Provider{def},
+		def:       def,
+	}
+}
+
+// Apply adds the providers and rules of rc. The default provider built from
+// the command line is known as "default".
+func (r *Router) Apply(rc *RoutingConfig, workers int, l *logger.ZapLogger) error {
+	byName := make(map[string]*Provider, len(r.providers)+len(rc.Providers))
+	for _, p := range r.providers {
+		byName[p.Name] = p
+	}
+	for _, pc := range rc.Providers {
+		if _, ok := byName[pc.Name]; ok || pc.Name == "" {
+			return fmt.Errorf("%w: %q", ErrDuplicateProvider, pc.Name)
+		}
+		p := NewProvider(pc.Name, pc.Address, pc.RPS, workers, l)
+		p.SetAuth(pc.Token, pc.User, pc.Password)
+		if pc.BreakerFailures > 0 || pc.BreakerCooldownSec > 0 {
+			p.SetBreaker(pc.BreakerFailures, time.Duration(pc.BreakerCooldownSec)*time.Second, defaultBreakerProbes, l)
+		}
+		byName[p.Name] = p
+		r.providers = append(r.providers, p)
+	}
+
+	for _, rl := range rc.Rules {
+		p, ok := byName[rl.Provider]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownProvider, rl.Provider)
+		}
+		if rl.Prefix == "" && rl.Group == "" {
+			return ErrBadRule
+		}
+		nr := rule{prefix: rl.Prefix, provider: p}
+		if rl.Group != "" {
+			users, ok := rc.Groups[rl.Group]
+			if !ok {
+				return fmt.Errorf("%w: unknown group %q", ErrBadRule, rl.Group)
+			}
+			nr.users = make(map[uint64]struct{}, len(users))
+			for _, id := range users {
+				nr.users[id] = struct{}{}
+			}
+		}
+		r.rules = append(r.rules, nr)
+	}
+
+	if rc.Default != "" {
+		p, ok := byName[rc.Default]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownProvider, rc.Default)
+		}
+		r.def = p
+	}
+	return nil
+}
+
+// Route returns the provider of the first matching rule or the default one.
+func (r *Router) Route(o store.Order) *Provider {
+	if len(r.rules) == 0 {
+		return r.def
+	}
+	number := strconv.FormatUint(o.OrderID, 10)
+	for i := range r.rules {
+		rl := &r.rules[i]
+		if rl.prefix != "" && !strings.HasPrefix(number, rl.prefix) {
+			continue
+		}
+		if rl.users != nil {
+			if _, ok := rl.users[o.UserID]; !ok {
+				continue
+			}
+		}
+		return rl.provider
+	}
+	return r.def
+}
+
+func (r *Router) Providers() []*Provider {
+	return r.providers
+}
+
+func (r *Router) Default() *Provider {
+	return r.def
+}
+
+func (r *Router) Start(ctx context.Context) error {
+	for _, p := range r.providers {
+		if err := p.Endpoints.Start(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Router) Stop(ctx context.Context) error {
+	for _, p := range r.providers {
+		_ = p.Endpoints.Stop(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package httpclientpool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter_Route(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	r := NewRouter(NewProvider(DefaultProvider, "localhost:8100", 0, 1, l))
+	require.NoError(t, r.Apply(&RoutingConfig{
+		Providers: []ProviderConfig{
+			{Name: "partner", Address: "partner:8100", Token: "secret"},
+			{Name: "vip", Address: "vip:8100", User: "u", Password: "p"},
+		},
+		Rules: []RuleConfig{
+			{Prefix: "777", Provider: "partner"},
+			{Group: "vip", Provider: "vip"},
+		},
+		Groups: map[string][]uint64{"vip": {7}},
+	}, 1, l))
+
+	tests := []struct {
+		name  string
+		order store.Order
+		want  string
+	}{
+		{name: "prefix", order: store.Order{OrderID: 7771234, UserID: 7}, want: "partner"},
+		{name: "group", order: store.Order{OrderID: 2377225624, UserID: 7}, want: "vip"},
+		{name: "default", order: store.Order{OrderID: 2377225624, UserID: 1}, want: DefaultProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, r.Route(tt.order).Name)
+		})
+	}
+
+	assert.ErrorIs(t, r.Apply(&RoutingConfig{Rules: []RuleConfig{{Prefix: "1", Provider: "nope"}}}, 1, l), ErrUnknownProvider)
+	assert.ErrorIs(t, r.Apply(&RoutingConfig{Providers: []ProviderConfig{{Name: "partner"}}}, 1, l), ErrDuplicateProvider)
+	assert.ErrorIs(t, r.Apply(&RoutingConfig{Rules: []RuleConfig{{Group: "vlp", Provider: "vip"}},
+		Groups: map[string][]uint64{"vip": {7}}}, 1, l), ErrBadRule)
+}
+
+func TestProvider_Auth(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	pr := NewProvider("partner", ts.URL, 0, 1, l)
+	pr.SetAuth("secret", "", "")
+	_, err = sendWithFailover(context.Background(), ts.Client(), pr, "2377225624", l)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer secret", got)
+}
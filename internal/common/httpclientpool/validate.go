@@ -0,0 +1,45 @@
+package httpclientpool
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/4aleksei/gmart/internal/common/models"
+)
+
+var (
+	ErrAnomaly = errors.New("anomalous accrual response")
+
+	ErrAnomalyOrder          = errors.New("order mismatch")
+	ErrAnomalyStatus         = errors.New("unknown status")
+	ErrAnomalyNegative       = errors.New("negative accrual")
+	ErrAnomalyInvalidAccrual = errors.New("accrual on invalid order")
+)
+
+// ValidateAccrual checks a response of the accrual system for the order.
+// A response that must not reach balances gives an error wrapping
+// ErrAnomaly and the reason.
+func ValidateAccrual(order string, v models.OrderAccrual) error {
+	var reason error
+	switch {
+	case v.OrderID != order:
+		reason = fmt.Errorf("%w: %q", ErrAnomalyOrder, v.OrderID)
+	case !knownStatus(v.Status):
+		reason = fmt.Errorf("%w: %q", ErrAnomalyStatus, v.Status)
+	case v.Accrual.IsNegative():
+		reason = fmt.Errorf("%w: %s", ErrAnomalyNegative, v.Accrual)
+	case v.Status == "INVALID" && !v.Accrual.IsZero():
+		reason = fmt.Errorf("%w: %s", ErrAnomalyInvalidAccrual, v.Accrual)
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrAnomaly, reason)
+}
+
+func knownStatus(s string) bool {
+	switch s {
+	case "REGISTERED", "PROCESSING", "INVALID", "PROCESSED":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package httpclientpool
+
+import (
+	"testing"
+
+	"github.com/4aleksei/gmart/internal/common/models"
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAccrual(t *testing.T) {
+	tests := []struct {
+		name   string
+		val    models.OrderAccrual
+		reason error
+	}{
+		{name: "processed", val: models.OrderAccrual{OrderID: "1", Status: "PROCESSED", Accrual: decimal.RequireFromString("500")}},
+		{name: "invalid", val: models.OrderAccrual{OrderID: "1", Status: "INVALID"}},
+		{name: "other order", val: models.OrderAccrual{OrderID: "2", Status: "PROCESSED"}, reason: ErrAnomalyOrder},
+		{name: "unknown status", val: models.OrderAccrual{OrderID: "1", Status: "DONE"}, reason: ErrAnomalyStatus},
+		{name: "negative", val: models.OrderAccrual{OrderID: "1", Status: "PROCESSED", Accrual: decimal.RequireFromString("-1")}, reason: ErrAnomalyNegative},
+		{name: "accrual on invalid", val: models.OrderAccrual{OrderID: "1", Status: "INVALID", Accrual: decimal.RequireFromString("10")}, reason: ErrAnomalyInvalidAccrual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAccrual("1", tt.val)
+			if tt.reason == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrAnomaly)
+			assert.ErrorIs(t, err, tt.reason)
+		})
+	}
+}
@@ -21,6 +21,19 @@ type (
 		Time    time.Time       `json:"uploaded_at"`
 	}
 
+	OrderStatus struct {
+		Status      string          `json:"status"`
+		Accrual     decimal.Decimal `json:"accrual,omitempty"`
+		Time        time.Time       `json:"changed_at"`
+		DurationSec float64         `json:"duration_sec"`
+	}
+
+	OrderDetail struct {
+		Order
+		Provider string        `json:"provider,omitempty"`
+		History  []OrderStatus `json:"history"`
+	}
+
 	OrderAccrual struct {
 		OrderID string          `json:"order"`
 		Status  string          `json:"status"`
@@ -37,6 +50,20 @@ type (
 		Sum     decimal.Decimal `json:"sum"`
 		TimeC   time.Time       `json:"processed_at,omitempty"`
 	}
+
+	LedgerEntry struct {
+		Type    string          `json:"type"`
+		Amount  decimal.Decimal `json:"amount"`
+		OrderID string          `json:"order"`
+		TimeC   time.Time       `json:"created_at"`
+	}
+
+	Health struct {
+		Status         string     `json:"status"`
+		Store          string     `json:"store"`
+		Accrual        string     `json:"accrual"`
+		AccrualRetryAt *time.Time `json:"accrual_retry_at,omitempty"`
+	}
 )
 
 func (val *Withdraw) FromJSON(body io.ReadCloser) error {
@@ -0,0 +1,34 @@
+// Package notify signals the accrual poller that there are new orders.
+package notify
+
+import (
+	"context"
+)
+
+// Notifier carries "new orders" signals. Signals are coalesced: any number
+// of Notify calls before the receiver reads C gives one signal.
+type Notifier interface {
+	Notify(context.Context) error
+	C() <-chan struct{}
+}
+
+// Local is an in-process Notifier.
+type Local struct {
+	ch chan struct{}
+}
+
+func NewLocal() *Local {
+	return &Local{ch: make(chan struct{}, 1)}
+}
+
+func (n *Local) Notify(ctx context.Context) error {
+	select {
+	case n.ch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (n *Local) C() <-chan struct{} {
+	return n.ch
+}
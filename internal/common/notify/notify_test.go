@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal_Coalesce(t *testing.T) {
+	n := NewLocal()
+	ctx := context.Background()
+
+	select {
+	case <-n.C():
+		t.Fatal("signal without notify")
+	default:
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, n.Notify(ctx))
+	}
+	_, ok := <-n.C()
+	assert.True(t, ok)
+
+	select {
+	case <-n.C():
+		t.Fatal("signals are not coalesced")
+	default:
+	}
+}
@@ -0,0 +1,533 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/greatcloak/decimal"
+)
+
+// MemStore is a thread-safe non-persistent store.Store with the same
+// semantics as pg.PgStore. It is meant for local runs and tests.
+type MemStore struct {
+	mu          sync.RWMutex
+	users       map[string]store.User
+	orders      map[uint64]store.Order
+	history     map[uint64][]store.OrderStatus
+	balances    map[uint64]store.Balance
+	withdrawals map[uint64]store.Withdraw
+	ledger      []store.LedgerEntry
+	idempotency map[idempotencyID]store.IdempotencyKey
+	anomalies   []store.Anomaly
+	lastUserID  uint64
+}
+
+type idempotencyID struct {
+	userID uint64
+	key    string
+}
+
+func New() *MemStore {
+	return &MemStore{
+		users:       make(map[string]store.User),
+		orders:      make(map[uint64]store.Order),
+		history:     make(map[uint64][]store.OrderStatus),
+		balances:    make(map[uint64]store.Balance),
+		withdrawals: make(map[uint64]store.Withdraw),
+		idempotency: make(map[idempotencyID]store.IdempotencyKey),
+	}
+}
+
+func (s *MemStore) AddUser(ctx context.Context, u store.User) (store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[u.Name]; ok {
+		return u, store.ErrAlreadyExists
+	}
+	s.lastUserID++
+	u.ID = s.lastUserID
+	s.users[u.Name] = u
+	return u, nil
+}
+
+func (s *MemStore) GetUser(ctx context.Context, u store.User) (store.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.users[u.Name]
+	if !ok {
+		return u, store.ErrRowNotFound
+	}
+	return val, nil
+}
+
+func (s *MemStore) InsertOrder(ctx context.Context, o store.Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[o.OrderID]; ok {
+		return store.ErrAlreadyExists
+	}
+	now := time.Now()
+	o.TimeU = now
+	o.TimeC = now
+	o.NextAttempt = now
+	s.orders[o.OrderID] = o
+	s.appendHistory(&o)
+	return nil
+}
+
+func (s *MemStore) InsertWithdraw(ctx context.Context, w store.Withdraw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.balances[w.UserID]
+	if b.Accrual.Compare(w.Sum) < 0 {
+		return store.ErrBalanceNotEnough
+	}
+	if _, ok := s.withdrawals[w.OrderID]; ok {
+		return store.ErrAlreadyExists
+	}
+
+	now := time.Now()
+	b.UserID = w.UserID
+	b.Accrual = b.Accrual.Sub(w.Sum)
+	b.Withdrawn = b.Withdrawn.Add(w.Sum)
+	b.TimeC = now
+	s.balances[w.UserID] = b
+
+	w.TimeC = now
+	s.withdrawals[w.OrderID] = w
+	s.appendLedger(w.UserID, store.LedgerDebit, w.Sum, w.OrderID, now)
+	return nil
+}
+
+func (s *MemStore) GetOrders(ctx context.Context, id uint64) ([]store.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectOrders(func(o *store.Order) bool { return o.UserID == id }), nil
+}
+
+func (s *MemStore) GetOrdersPage(ctx context.Context, f store.PageFilter) ([]store.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ores := s.selectOrders(func(o *store.Order) bool {
+		return o.UserID == f.UserID && (f.Status == "" || o.Status == f.Status) &&
+			inPage(&f, o.TimeU, o.OrderID)
+	})
+	if f.Limit > 0 && len(ores) > f.Limit {
+		ores = ores[:f.Limit]
+	}
+	return ores, nil
+}
+
+func (s *MemStore) GetOneOrder(ctx context.Context, id uint64) (store.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return o, store.ErrRowNotFound
+	}
+	return o, nil
+}
+
+func (s *MemStore) GetOrderHistory(ctx context.Context, id uint64) ([]store.OrderStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hist := make([]store.OrderStatus, len(s.history[id]))
+	copy(hist, s.history[id])
+	return hist, nil
+}
+
+func (s *MemStore) GetBalance(ctx context.Context, id uint64) (store.Balance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := store.Balance{UserID: id}
+	var found bool
+	for i := range s.ledger {
+		e := &s.ledger[i]
+		if e.UserID != id {
+			continue
+		}
+		found = true
+		if e.Type == store.LedgerCredit {
+			b.Accrual = b.Accrual.Add(e.Amount)
+		} else {
+			b.Accrual = b.Accrual.Sub(e.Amount)
+			b.Withdrawn = b.Withdrawn.Add(e.Amount)
+		}
+		if e.TimeC.After(b.TimeC) {
+			b.TimeC = e.TimeC
+		}
+	}
+	if !found {
+		return b, store.ErrRowNotFound
+	}
+	return b, nil
+}
+
+func (s *MemStore) GetWithdrawals(ctx context.Context, id uint64) ([]store.Withdraw, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withs := make([]store.Withdraw, 0)
+	for _, w := range s.withdrawals {
+		if w.UserID == id {
+			withs = append(withs, w)
+		}
+	}
+	sort.Slice(withs, func(i, j int) bool {
+		if withs[i].TimeC.Equal(withs[j].TimeC) {
+			return withs[i].OrderID < withs[j].OrderID
+		}
+		return withs[i].TimeC.Before(withs[j].TimeC)
+	})
+	return withs, nil
+}
+
+func (s *MemStore) GetWithdrawalsPage(ctx context.Context, f store.PageFilter) ([]store.Withdraw, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withs := make([]store.Withdraw, 0)
+	for _, w := range s.withdrawals {
+		if w.UserID == f.UserID && inPage(&f, w.TimeC, w.OrderID) {
+			withs = append(withs, w)
+		}
+	}
+	sort.Slice(withs, func(i, j int) bool {
+		if withs[i].TimeC.Equal(withs[j].TimeC) {
+			return withs[i].OrderID > withs[j].OrderID
+		}
+		return withs[i].TimeC.After(withs[j].TimeC)
+	})
+	if f.Limit > 0 && len(withs) > f.Limit {
+		withs = withs[:f.Limit]
+	}
+	return withs, nil
+}
+
+func (s *MemStore) GetLedger(ctx context.Context, id uint64) ([]store.LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]store.LedgerEntry, 0)
+	for i := len(s.ledger) - 1; i >= 0; i-- {
+		if s.ledger[i].UserID == id {
+			entries = append(entries, s.ledger[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemStore) ClaimOrdersForProcessing(ctx context.Context, limit int, lease time.Duration) ([]store.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ores := s.selectOrders(func(o *store.Order) bool {
+		return (o.Status == "NEW" || o.Status == "REGISTERED" || o.Status == "PROCESSING") &&
+			o.StaleAt.IsZero() && o.DeadAt.IsZero() && !o.NextAttempt.After(now) && o.LeasedUntil.Before(now)
+	})
+	sort.Slice(ores, func(i, j int) bool {
+		if ores[i].NextAttempt.Equal(ores[j].NextAttempt) {
+			return ores[i].TimeU.Before(ores[j].TimeU)
+		}
+		return ores[i].NextAttempt.Before(ores[j].NextAttempt)
+	})
+	if len(ores) > limit {
+		ores = ores[:limit]
+	}
+	for i := range ores {
+		ores[i].LeasedUntil = now.Add(lease)
+		ores[i].Attempts++
+		s.orders[ores[i].OrderID] = ores[i]
+	}
+	return ores, nil
+}
+
+func (s *MemStore) ReleaseOrders(ctx context.Context, ids []uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if o, ok := s.orders[id]; ok {
+			o.LeasedUntil = time.Time{}
+			s.orders[id] = o
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) ScheduleOrders(ctx context.Context, sched []store.OrderSchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, v := range sched {
+		o, ok := s.orders[v.OrderID]
+		if !ok {
+			continue
+		}
+		o.LeasedUntil = time.Time{}
+		o.NextAttempt = v.NextAttempt
+		o.Attempts = v.Attempts
+		o.Failures = v.Failures
+		o.StaleAt = time.Time{}
+		if v.Stale {
+			o.StaleAt = now
+		}
+		o.DeadAt = time.Time{}
+		if v.Dead {
+			o.DeadAt = now
+		}
+		o.LastError = v.LastError
+		if v.Provider != "" {
+			o.Provider = v.Provider
+		}
+		s.orders[v.OrderID] = o
+	}
+	return nil
+}
+
+func (s *MemStore) GetDeadOrders(ctx context.Context, limit int) ([]store.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ores := s.selectOrders(func(o *store.Order) bool { return !o.DeadAt.IsZero() || !o.StaleAt.IsZero() })
+	deadTime := func(o *store.Order) time.Time {
+		if !o.DeadAt.IsZero() {
+			return o.DeadAt
+		}
+		return o.StaleAt
+	}
+	sort.SliceStable(ores, func(i, j int) bool {
+		return deadTime(&ores[i]).After(deadTime(&ores[j]))
+	})
+	if len(ores) > limit {
+		ores = ores[:limit]
+	}
+	return ores, nil
+}
+
+func (s *MemStore) RequeueOrders(ctx context.Context, ids []uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var n int
+	for _, id := range ids {
+		o, ok := s.orders[id]
+		if !ok || (o.DeadAt.IsZero() && o.StaleAt.IsZero()) {
+			continue
+		}
+		o.DeadAt = time.Time{}
+		o.StaleAt = time.Time{}
+		o.LastError = ""
+		o.Attempts = 0
+		o.Failures = 0
+		o.NextAttempt = now
+		o.LeasedUntil = time.Time{}
+		s.orders[id] = o
+		n++
+	}
+	return n, nil
+}
+
+func (s *MemStore) InsertAnomalies(ctx context.Context, anomalies []store.Anomaly) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range anomalies {
+		if _, ok := s.orders[a.OrderID]; !ok {
+			return store.ErrRowNotFound
+		}
+	}
+	now := time.Now()
+	for _, a := range anomalies {
+		a.ID = uint64(len(s.anomalies) + 1)
+		a.Payload = append([]byte(nil), a.Payload...)
+		a.TimeC = now
+		s.anomalies = append(s.anomalies, a)
+	}
+	return nil
+}
+
+func (s *MemStore) GetAnomalies(ctx context.Context, limit int) ([]store.Anomaly, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]store.Anomaly, 0, min(limit, len(s.anomalies)))
+	for i := len(s.anomalies) - 1; i >= 0 && len(res) < limit; i-- {
+		res = append(res, s.anomalies[i])
+	}
+	return res, nil
+}
+
+func (s *MemStore) UpdateOrdersBalancesBatch(ctx context.Context, orders []store.Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, upd := range orders {
+		o, ok := s.orders[upd.OrderID]
+		if !ok || o.Status == "PROCESSED" || o.Status == "INVALID" || o.Status == upd.Status {
+			continue
+		}
+		o.Status = upd.Status
+		o.Accrual = upd.Accrual
+		o.TimeC = now
+		s.orders[o.OrderID] = o
+		s.appendHistory(&o)
+
+		if o.Status != "PROCESSED" || !o.Accrual.IsPositive() {
+			continue
+		}
+
+		b := s.balances[o.UserID]
+		b.UserID = o.UserID
+		b.Accrual = b.Accrual.Add(o.Accrual)
+		b.TimeC = now
+		s.balances[o.UserID] = b
+
+		s.appendLedger(o.UserID, store.LedgerCredit, o.Accrual, o.OrderID, now)
+	}
+	return nil
+}
+
+func (s *MemStore) ReserveIdempotencyKey(ctx context.Context, k store.IdempotencyKey) (store.IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyID{userID: k.UserID, key: k.Key}
+	if old, ok := s.idempotency[id]; ok {
+		return old, store.ErrAlreadyExists
+	}
+	k.StatusCode = 0
+	k.ContentType = ""
+	k.Response = nil
+	k.TimeC = time.Now()
+	s.idempotency[id] = k
+	return k, nil
+}
+
+func (s *MemStore) TakeOverIdempotencyKey(ctx context.Context, k store.IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyID{userID: k.UserID, key: k.Key}
+	old, ok := s.idempotency[id]
+	if !ok || old.StatusCode != 0 || !old.TimeC.Equal(k.TimeC) {
+		return store.ErrConflict
+	}
+	old.TimeC = time.Now()
+	s.idempotency[id] = old
+	return nil
+}
+
+func (s *MemStore) CompleteIdempotencyKey(ctx context.Context, k store.IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyID{userID: k.UserID, key: k.Key}
+	old, ok := s.idempotency[id]
+	if !ok {
+		return store.ErrRowNotFound
+	}
+	old.StatusCode = k.StatusCode
+	old.ContentType = k.ContentType
+	old.Response = append([]byte(nil), k.Response...)
+	s.idempotency[id] = old
+	return nil
+}
+
+func (s *MemStore) DeleteIdempotencyKey(ctx context.Context, userID uint64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, idempotencyID{userID: userID, key: key})
+	return nil
+}
+
+func (s *MemStore) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, k := range s.idempotency {
+		if k.TimeC.Before(before) {
+			delete(s.idempotency, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemStore) Close(ctx context.Context) {
+}
+
+func (s *MemStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemStore) appendHistory(o *store.Order) {
+	s.history[o.OrderID] = append(s.history[o.OrderID], store.OrderStatus{
+		OrderID: o.OrderID,
+		Status:  o.Status,
+		Accrual: o.Accrual,
+		TimeC:   o.TimeC,
+	})
+}
+
+func (s *MemStore) appendLedger(userID uint64, typ string, amount decimal.Decimal, orderID uint64, t time.Time) {
+	s.ledger = append(s.ledger, store.LedgerEntry{
+		ID:      uint64(len(s.ledger) + 1),
+		UserID:  userID,
+		Type:    typ,
+		Amount:  amount,
+		OrderID: orderID,
+		TimeC:   t,
+	})
+}
+
+// inPage reports whether a row keyed by (t, id) matches the date range
+// of the filter and sorts after its cursor.
+func inPage(f *store.PageFilter, t time.Time, id uint64) bool {
+	if !f.From.IsZero() && t.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !t.Before(f.To) {
+		return false
+	}
+	if !f.CursorTime.IsZero() {
+		if t.After(f.CursorTime) || (t.Equal(f.CursorTime) && id >= f.CursorID) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemStore) selectOrders(filter func(*store.Order) bool) []store.Order {
+	ores := make([]store.Order, 0)
+	for _, o := range s.orders {
+		if filter(&o) {
+			ores = append(ores, o)
+		}
+	}
+	sort.Slice(ores, func(i, j int) bool {
+		if ores[i].TimeU.Equal(ores[j].TimeU) {
+			return ores[i].OrderID > ores[j].OrderID
+		}
+		return ores[i].TimeU.After(ores[j].TimeU)
+	})
+	return ores
+}
@@ -0,0 +1,340 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStore_Users(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	u, err := s.AddUser(ctx, store.User{Name: "Vasia", Password: "pass"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), u.ID)
+
+	_, err = s.AddUser(ctx, store.User{Name: "Vasia", Password: "other"})
+	assert.ErrorIs(t, err, store.ErrAlreadyExists)
+
+	got, err := s.GetUser(ctx, store.User{Name: "Vasia"})
+	require.NoError(t, err)
+	assert.Equal(t, u, got)
+
+	_, err = s.GetUser(ctx, store.User{Name: "Petia"})
+	assert.ErrorIs(t, err, store.ErrRowNotFound)
+}
+
+func TestMemStore_OrdersAndWithdraw(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: 5062821234567892, UserID: 1, Status: "NEW"}))
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: 2377225624, UserID: 1, Status: "NEW"}))
+	assert.ErrorIs(t, s.InsertOrder(ctx, store.Order{OrderID: 2377225624, UserID: 2, Status: "NEW"}), store.ErrAlreadyExists)
+
+	_, err := s.GetBalance(ctx, 1)
+	assert.ErrorIs(t, err, store.ErrRowNotFound)
+
+	err = s.InsertWithdraw(ctx, store.Withdraw{UserID: 1, OrderID: 2377225625, Sum: decimal.RequireFromString("1")})
+	assert.ErrorIs(t, err, store.ErrBalanceNotEnough)
+
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("500")},
+		{OrderID: 2377225624, UserID: 1, Status: "PROCESSING", Accrual: decimal.Zero},
+	}))
+
+	processing, err := s.ClaimOrdersForProcessing(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, processing, 1)
+	assert.Equal(t, uint64(2377225624), processing[0].OrderID)
+
+	require.NoError(t, s.InsertWithdraw(ctx, store.Withdraw{UserID: 1, OrderID: 2377225625, Sum: decimal.RequireFromString("200")}))
+	err = s.InsertWithdraw(ctx, store.Withdraw{UserID: 1, OrderID: 2377225625, Sum: decimal.RequireFromString("10")})
+	assert.ErrorIs(t, err, store.ErrAlreadyExists)
+	err = s.InsertWithdraw(ctx, store.Withdraw{UserID: 1, OrderID: 2377225626, Sum: decimal.RequireFromString("301")})
+	assert.ErrorIs(t, err, store.ErrBalanceNotEnough)
+
+	b, err := s.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("300").Equal(b.Accrual))
+	assert.True(t, decimal.RequireFromString("200").Equal(b.Withdrawn))
+
+	ledger, err := s.GetLedger(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, ledger, 2)
+	assert.Equal(t, store.LedgerDebit, ledger[0].Type)
+	assert.Equal(t, store.LedgerCredit, ledger[1].Type)
+}
+
+func TestMemStore_ConcurrentWithdraw(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: 5062821234567892, UserID: 1, Status: "NEW"}))
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("100")},
+	}))
+
+	const workers = 50
+	var wg sync.WaitGroup
+	var success, notEnough atomic.Int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.InsertWithdraw(ctx, store.Withdraw{UserID: 1, OrderID: uint64(1000 + i), Sum: decimal.RequireFromString("10")})
+			switch {
+			case err == nil:
+				success.Add(1)
+			case errors.Is(err, store.ErrBalanceNotEnough):
+				notEnough.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(10), success.Load())
+	assert.Equal(t, int64(workers-10), notEnough.Load())
+
+	b, err := s.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, b.Accrual.IsZero())
+	assert.True(t, decimal.RequireFromString("100").Equal(b.Withdrawn))
+}
+
+func TestMemStore_CreditOnce(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: 5062821234567892, UserID: 1, Status: "NEW"}))
+
+	processed := store.Order{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("500")}
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSING", Accrual: decimal.Zero},
+		processed,
+		processed,
+	}))
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{processed}))
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("700")},
+	}))
+
+	b, err := s.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("500").Equal(b.Accrual))
+
+	o, err := s.GetOneOrder(ctx, 5062821234567892)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("500").Equal(o.Accrual))
+
+	ledger, err := s.GetLedger(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, ledger, 1)
+
+	hist, err := s.GetOrderHistory(ctx, 5062821234567892)
+	require.NoError(t, err)
+	require.Len(t, hist, 3)
+	assert.Equal(t, "NEW", hist[0].Status)
+	assert.Equal(t, "PROCESSING", hist[1].Status)
+	assert.Equal(t, "PROCESSED", hist[2].Status)
+}
+
+func TestMemStore_ClaimLease(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	for i := uint64(1); i <= 5; i++ {
+		require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: i, UserID: 1, Status: "NEW"}))
+	}
+
+	first, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, first, 3)
+
+	second, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	for _, o := range second {
+		for _, f := range first {
+			assert.NotEqual(t, f.OrderID, o.OrderID)
+		}
+	}
+
+	none, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	require.NoError(t, s.ReleaseOrders(ctx, []uint64{first[0].OrderID}))
+	again, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, first[0].OrderID, again[0].OrderID)
+	assert.Equal(t, 2, again[0].Attempts)
+}
+
+func TestMemStore_OrdersPage(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	for i := uint64(1); i <= 5; i++ {
+		require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: i, UserID: 1, Status: "NEW"}))
+	}
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: 100, UserID: 2, Status: "NEW"}))
+
+	f := store.PageFilter{UserID: 1, Limit: 2}
+	var got []uint64
+	for {
+		page, err := s.GetOrdersPage(ctx, f)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		for _, o := range page {
+			got = append(got, o.OrderID)
+		}
+		last := page[len(page)-1]
+		f.CursorTime, f.CursorID = last.TimeU, last.OrderID
+	}
+	assert.Len(t, got, 5)
+	for i := 1; i < len(got); i++ {
+		assert.NotEqual(t, got[i-1], got[i])
+	}
+
+	page, err := s.GetOrdersPage(ctx, store.PageFilter{UserID: 1, Status: "PROCESSED"})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+}
+
+func TestMemStore_ScheduleOrders(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: i, UserID: 1, Status: "NEW"}))
+	}
+	claimed, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 3)
+
+	now := time.Now()
+	require.NoError(t, s.ScheduleOrders(ctx, []store.OrderSchedule{
+		{OrderID: 1, Attempts: 1, NextAttempt: now},
+		{OrderID: 2, Attempts: 1, NextAttempt: now.Add(time.Hour)},
+		{OrderID: 3, Attempts: 1, NextAttempt: now, Stale: true},
+	}))
+
+	again, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, uint64(1), again[0].OrderID)
+	assert.Equal(t, 2, again[0].Attempts)
+
+	o, err := s.GetOneOrder(ctx, 3)
+	require.NoError(t, err)
+	assert.False(t, o.StaleAt.IsZero())
+}
+
+func TestMemStore_DeadOrders(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: i, UserID: 1, Status: "NEW"}))
+	}
+	_, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, s.ScheduleOrders(ctx, []store.OrderSchedule{
+		{OrderID: 1, Attempts: 20, NextAttempt: now, Dead: true, LastError: "order not registered in accrual"},
+		{OrderID: 2, Attempts: 1, NextAttempt: now, Stale: true},
+		{OrderID: 3, Attempts: 1, NextAttempt: now.Add(time.Hour)},
+	}))
+
+	dead, err := s.GetDeadOrders(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 2)
+	for _, o := range dead {
+		if o.OrderID == 1 {
+			assert.Equal(t, "order not registered in accrual", o.LastError)
+		}
+	}
+
+	none, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	n, err := s.RequeueOrders(ctx, []uint64{1, 3})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	again, err := s.ClaimOrdersForProcessing(ctx, 3, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, uint64(1), again[0].OrderID)
+	assert.Equal(t, 1, again[0].Attempts)
+	assert.Empty(t, again[0].LastError)
+}
+
+func TestMemStore_TakeOverIdempotencyKey(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	k := store.IdempotencyKey{UserID: 1, Key: "key-1", Fingerprint: "f"}
+	_, err := s.ReserveIdempotencyKey(ctx, k)
+	require.NoError(t, err)
+	old, err := s.ReserveIdempotencyKey(ctx, k)
+	require.ErrorIs(t, err, store.ErrAlreadyExists)
+
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.TakeOverIdempotencyKey(ctx, old); err == nil {
+				taken.Add(1)
+			} else {
+				assert.ErrorIs(t, err, store.ErrConflict)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), taken.Load())
+
+	cur, err := s.ReserveIdempotencyKey(ctx, k)
+	require.ErrorIs(t, err, store.ErrAlreadyExists)
+	require.NoError(t, s.CompleteIdempotencyKey(ctx, store.IdempotencyKey{UserID: 1, Key: "key-1", StatusCode: 200}))
+	assert.ErrorIs(t, s.TakeOverIdempotencyKey(ctx, cur), store.ErrConflict)
+}
+
+func TestMemStore_DeleteExpiredIdempotencyKeys(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+
+	_, err := s.ReserveIdempotencyKey(ctx, store.IdempotencyKey{UserID: 1, Key: "old"})
+	require.NoError(t, err)
+	cutoff := time.Now()
+	_, err = s.ReserveIdempotencyKey(ctx, store.IdempotencyKey{UserID: 1, Key: "new"})
+	require.NoError(t, err)
+
+	n, err := s.DeleteExpiredIdempotencyKeys(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = s.ReserveIdempotencyKey(ctx, store.IdempotencyKey{UserID: 1, Key: "old"})
+	assert.NoError(t, err)
+	_, err = s.ReserveIdempotencyKey(ctx, store.IdempotencyKey{UserID: 1, Key: "new"})
+	assert.ErrorIs(t, err, store.ErrAlreadyExists)
+}
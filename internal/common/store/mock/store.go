@@ -7,6 +7,7 @@ package mock
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	store "github.com/4aleksei/gmart/internal/common/store"
 	gomock "github.com/golang/mock/gomock"
@@ -50,6 +51,21 @@ func (mr *MockStoreMockRecorder) AddUser(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddUser", reflect.TypeOf((*MockStore)(nil).AddUser), arg0, arg1)
 }
 
+// ClaimOrdersForProcessing mocks base method.
+func (m *MockStore) ClaimOrdersForProcessing(arg0 context.Context, arg1 int, arg2 time.Duration) ([]store.Order, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimOrdersForProcessing", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]store.Order)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimOrdersForProcessing indicates an expected call of ClaimOrdersForProcessing.
+func (mr *MockStoreMockRecorder) ClaimOrdersForProcessing(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimOrdersForProcessing", reflect.TypeOf((*MockStore)(nil).ClaimOrdersForProcessing), arg0, arg1, arg2)
+}
+
 // Close mocks base method.
 func (m *MockStore) Close(arg0 context.Context) {
 	m.ctrl.T.Helper()
@@ -62,6 +78,64 @@ func (mr *MockStoreMockRecorder) Close(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockStore)(nil).Close), arg0)
 }
 
+// CompleteIdempotencyKey mocks base method.
+func (m *MockStore) CompleteIdempotencyKey(arg0 context.Context, arg1 store.IdempotencyKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteIdempotencyKey", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteIdempotencyKey indicates an expected call of CompleteIdempotencyKey.
+func (mr *MockStoreMockRecorder) CompleteIdempotencyKey(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteIdempotencyKey", reflect.TypeOf((*MockStore)(nil).CompleteIdempotencyKey), arg0, arg1)
+}
+
+// DeleteExpiredIdempotencyKeys mocks base method.
+func (m *MockStore) DeleteExpiredIdempotencyKeys(arg0 context.Context, arg1 time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredIdempotencyKeys", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredIdempotencyKeys indicates an expected call of DeleteExpiredIdempotencyKeys.
+func (mr *MockStoreMockRecorder) DeleteExpiredIdempotencyKeys(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredIdempotencyKeys", reflect.TypeOf((*MockStore)(nil).DeleteExpiredIdempotencyKeys), arg0, arg1)
+}
+
+// DeleteIdempotencyKey mocks base method.
+func (m *MockStore) DeleteIdempotencyKey(arg0 context.Context, arg1 uint64, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIdempotencyKey indicates an expected call of DeleteIdempotencyKey.
+func (mr *MockStoreMockRecorder) DeleteIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIdempotencyKey", reflect.TypeOf((*MockStore)(nil).DeleteIdempotencyKey), arg0, arg1, arg2)
+}
+
+// GetAnomalies mocks base method.
+func (m *MockStore) GetAnomalies(arg0 context.Context, arg1 int) ([]store.Anomaly, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAnomalies", arg0, arg1)
+	ret0, _ := ret[0].([]store.Anomaly)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAnomalies indicates an expected call of GetAnomalies.
+func (mr *MockStoreMockRecorder) GetAnomalies(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAnomalies", reflect.TypeOf((*MockStore)(nil).GetAnomalies), arg0, arg1)
+}
+
 // GetBalance mocks base method.
 func (m *MockStore) GetBalance(arg0 context.Context, arg1 uint64) (store.Balance, error) {
 	m.ctrl.T.Helper()
@@ -77,6 +151,36 @@ func (mr *MockStoreMockRecorder) GetBalance(arg0, arg1 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBalance", reflect.TypeOf((*MockStore)(nil).GetBalance), arg0, arg1)
 }
 
+// GetDeadOrders mocks base method.
+func (m *MockStore) GetDeadOrders(arg0 context.Context, arg1 int) ([]store.Order, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeadOrders", arg0, arg1)
+	ret0, _ := ret[0].([]store.Order)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeadOrders indicates an expected call of GetDeadOrders.
+func (mr *MockStoreMockRecorder) GetDeadOrders(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeadOrders", reflect.TypeOf((*MockStore)(nil).GetDeadOrders), arg0, arg1)
+}
+
+// GetLedger mocks base method.
+func (m *MockStore) GetLedger(arg0 context.Context, arg1 uint64) ([]store.LedgerEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLedger", arg0, arg1)
+	ret0, _ := ret[0].([]store.LedgerEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLedger indicates an expected call of GetLedger.
+func (mr *MockStoreMockRecorder) GetLedger(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLedger", reflect.TypeOf((*MockStore)(nil).GetLedger), arg0, arg1)
+}
+
 // GetOneOrder mocks base method.
 func (m *MockStore) GetOneOrder(arg0 context.Context, arg1 uint64) (store.Order, error) {
 	m.ctrl.T.Helper()
@@ -92,6 +196,21 @@ func (mr *MockStoreMockRecorder) GetOneOrder(arg0, arg1 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOneOrder", reflect.TypeOf((*MockStore)(nil).GetOneOrder), arg0, arg1)
 }
 
+// GetOrderHistory mocks base method.
+func (m *MockStore) GetOrderHistory(arg0 context.Context, arg1 uint64) ([]store.OrderStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrderHistory", arg0, arg1)
+	ret0, _ := ret[0].([]store.OrderStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOrderHistory indicates an expected call of GetOrderHistory.
+func (mr *MockStoreMockRecorder) GetOrderHistory(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderHistory", reflect.TypeOf((*MockStore)(nil).GetOrderHistory), arg0, arg1)
+}
+
 // GetOrders mocks base method.
 func (m *MockStore) GetOrders(arg0 context.Context, arg1 uint64) ([]store.Order, error) {
 	m.ctrl.T.Helper()
@@ -107,19 +226,19 @@ func (mr *MockStoreMockRecorder) GetOrders(arg0, arg1 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrders", reflect.TypeOf((*MockStore)(nil).GetOrders), arg0, arg1)
 }
 
-// GetOrdersForProcessing mocks base method.
-func (m *MockStore) GetOrdersForProcessing(arg0 context.Context) ([]store.Order, error) {
+// GetOrdersPage mocks base method.
+func (m *MockStore) GetOrdersPage(arg0 context.Context, arg1 store.PageFilter) ([]store.Order, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetOrdersForProcessing", arg0)
+	ret := m.ctrl.Call(m, "GetOrdersPage", arg0, arg1)
 	ret0, _ := ret[0].([]store.Order)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetOrdersForProcessing indicates an expected call of GetOrdersForProcessing.
-func (mr *MockStoreMockRecorder) GetOrdersForProcessing(arg0 interface{}) *gomock.Call {
+// GetOrdersPage indicates an expected call of GetOrdersPage.
+func (mr *MockStoreMockRecorder) GetOrdersPage(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersForProcessing", reflect.TypeOf((*MockStore)(nil).GetOrdersForProcessing), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrdersPage", reflect.TypeOf((*MockStore)(nil).GetOrdersPage), arg0, arg1)
 }
 
 // GetUser mocks base method.
@@ -152,6 +271,35 @@ func (mr *MockStoreMockRecorder) GetWithdrawals(arg0, arg1 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawals", reflect.TypeOf((*MockStore)(nil).GetWithdrawals), arg0, arg1)
 }
 
+// GetWithdrawalsPage mocks base method.
+func (m *MockStore) GetWithdrawalsPage(arg0 context.Context, arg1 store.PageFilter) ([]store.Withdraw, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWithdrawalsPage", arg0, arg1)
+	ret0, _ := ret[0].([]store.Withdraw)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetWithdrawalsPage indicates an expected call of GetWithdrawalsPage.
+func (mr *MockStoreMockRecorder) GetWithdrawalsPage(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawalsPage", reflect.TypeOf((*MockStore)(nil).GetWithdrawalsPage), arg0, arg1)
+}
+
+// InsertAnomalies mocks base method.
+func (m *MockStore) InsertAnomalies(arg0 context.Context, arg1 []store.Anomaly) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertAnomalies", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertAnomalies indicates an expected call of InsertAnomalies.
+func (mr *MockStoreMockRecorder) InsertAnomalies(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertAnomalies", reflect.TypeOf((*MockStore)(nil).InsertAnomalies), arg0, arg1)
+}
+
 // InsertOrder mocks base method.
 func (m *MockStore) InsertOrder(arg0 context.Context, arg1 store.Order) error {
 	m.ctrl.T.Helper()
@@ -194,6 +342,78 @@ func (mr *MockStoreMockRecorder) Ping(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStore)(nil).Ping), arg0)
 }
 
+// ReleaseOrders mocks base method.
+func (m *MockStore) ReleaseOrders(arg0 context.Context, arg1 []uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseOrders", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseOrders indicates an expected call of ReleaseOrders.
+func (mr *MockStoreMockRecorder) ReleaseOrders(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseOrders", reflect.TypeOf((*MockStore)(nil).ReleaseOrders), arg0, arg1)
+}
+
+// RequeueOrders mocks base method.
+func (m *MockStore) RequeueOrders(arg0 context.Context, arg1 []uint64) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueOrders", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueOrders indicates an expected call of RequeueOrders.
+func (mr *MockStoreMockRecorder) RequeueOrders(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueOrders", reflect.TypeOf((*MockStore)(nil).RequeueOrders), arg0, arg1)
+}
+
+// ReserveIdempotencyKey mocks base method.
+func (m *MockStore) ReserveIdempotencyKey(arg0 context.Context, arg1 store.IdempotencyKey) (store.IdempotencyKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReserveIdempotencyKey", arg0, arg1)
+	ret0, _ := ret[0].(store.IdempotencyKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReserveIdempotencyKey indicates an expected call of ReserveIdempotencyKey.
+func (mr *MockStoreMockRecorder) ReserveIdempotencyKey(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReserveIdempotencyKey", reflect.TypeOf((*MockStore)(nil).ReserveIdempotencyKey), arg0, arg1)
+}
+
+// ScheduleOrders mocks base method.
+func (m *MockStore) ScheduleOrders(arg0 context.Context, arg1 []store.OrderSchedule) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScheduleOrders", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ScheduleOrders indicates an expected call of ScheduleOrders.
+func (mr *MockStoreMockRecorder) ScheduleOrders(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScheduleOrders", reflect.TypeOf((*MockStore)(nil).ScheduleOrders), arg0, arg1)
+}
+
+// TakeOverIdempotencyKey mocks base method.
+func (m *MockStore) TakeOverIdempotencyKey(arg0 context.Context, arg1 store.IdempotencyKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TakeOverIdempotencyKey", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TakeOverIdempotencyKey indicates an expected call of TakeOverIdempotencyKey.
+func (mr *MockStoreMockRecorder) TakeOverIdempotencyKey(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TakeOverIdempotencyKey", reflect.TypeOf((*MockStore)(nil).TakeOverIdempotencyKey), arg0, arg1)
+}
+
 // UpdateOrdersBalancesBatch mocks base method.
 func (m *MockStore) UpdateOrdersBalancesBatch(arg0 context.Context, arg1 []store.Order) error {
 	m.ctrl.T.Helper()
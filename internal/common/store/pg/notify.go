@@ -0,0 +1,95 @@
+package pg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/notify"
+	"github.com/4aleksei/gmart/internal/common/utils"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultNotifyChannel = "gmart_new_orders"
+
+	listenRetry = time.Second
+)
+
+// Notifier carries new order signals between processes sharing the
+// database with LISTEN/NOTIFY. Signals of this process come back the
+// same way.
+type Notifier struct {
+	*notify.Local
+	s       *PgStore
+	channel string
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewNotifier(s *PgStore, channel string) *Notifier {
+	return &Notifier{
+		Local:   notify.NewLocal(),
+		s:       s,
+		channel: channel,
+	}
+}
+
+// Notify sends the signal to all listeners. If it cannot, at least the
+// poller of this process is woken.
+func (n *Notifier) Notify(ctx context.Context) error {
+	_, err := n.s.pool.Exec(ctx, "SELECT pg_notify($1, '')", n.channel)
+	if err != nil {
+		_ = n.Local.Notify(ctx)
+	}
+	return err
+}
+
+func (n *Notifier) Start(ctx context.Context) error {
+	ctxCancel, cancel := context.WithCancel(context.Background())
+	n.cancel = cancel
+	n.wg.Add(1)
+	go n.listen(ctxCancel)
+	return nil
+}
+
+func (n *Notifier) Stop(ctx context.Context) error {
+	n.cancel()
+	n.wg.Wait()
+	return nil
+}
+
+func (n *Notifier) listen(ctx context.Context) {
+	defer n.wg.Done()
+	for ctx.Err() == nil {
+		err := n.listenConn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		n.s.l.Logger.Debug("notify: listen error, reconnect", zap.Error(err))
+		utils.SleepCancellable(ctx, listenRetry)
+	}
+}
+
+// listenConn holds a dedicated connection while waiting for notifications.
+func (n *Notifier) listenConn(ctx context.Context) error {
+	pc, err := n.s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	conn := pc.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{n.channel}.Sanitize()); err != nil {
+		return err
+	}
+	// orders registered while not listening
+	_ = n.Local.Notify(ctx)
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		_ = n.Local.Notify(ctx)
+	}
+}
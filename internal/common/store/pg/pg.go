@@ -28,9 +28,9 @@ type (
 )
 
 var (
-	ErrAlreadyExists    = errors.New("already exists")
-	ErrRowNotFound      = errors.New("not found")
-	ErrBalanceNotEnough = errors.New("balance not enough")
+	ErrAlreadyExists    = store.ErrAlreadyExists
+	ErrRowNotFound      = store.ErrRowNotFound
+	ErrBalanceNotEnough = store.ErrBalanceNotEnough
 )
 
 func New(l *logger.ZapLogger) *PgStore {
@@ -57,8 +57,15 @@ func ProbePGErrorConstrain(err error) bool {
 	var pgErr *pgconn.PgError
 
 	if errors.As(err, &pgErr) {
-		fmt.Println(err)
-		return pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) && pgErr.Code == "23514"
+		return pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) && pgErr.Code == pgerrcode.CheckViolation
+	}
+	return false
+}
+
+func ProbePGSerialization(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgerrcode.SerializationFailure || pgErr.Code == pgerrcode.DeadlockDetected
 	}
 	return false
 }
@@ -108,22 +115,94 @@ const (
 	queryDefault = `INSERT INTO users (name, password , created_at) VALUES ($1,$2,now())
 	 RETURNING name, password, user_id`
 
-	queryROrderDefault = `INSERT INTO orders (order_id, user_id , status ,accrual , uploaded_at, changed_at)
-	       VALUES ($1,$2, $3 , $4 ,now(),now())
-		    RETURNING order_id, user_id , status ,accrual`
+	queryROrderDefault = `WITH ins AS (
+			INSERT INTO orders (order_id, user_id , status ,accrual , uploaded_at, changed_at)
+			VALUES ($1,$2, $3 , $4 ,now(),now())
+			RETURNING order_id, user_id , status ,accrual , uploaded_at
+		), hist AS (
+			INSERT INTO order_status_history (order_id , status , accrual , changed_at)
+			SELECT order_id, status, accrual, uploaded_at FROM ins
+		)
+		SELECT order_id, user_id , status ,accrual FROM ins`
+
+	selectOrderHistoryDefault = `SELECT order_id , status , accrual , changed_at FROM order_status_history
+	                              WHERE order_id = $1 ORDER BY changed_at, history_id`
 
 	selectDefault = `SELECT name, password, user_id  FROM users WHERE name = $1`
 
 	selectOrdersDefault = `SELECT  order_id, user_id , status ,accrual , uploaded_at, changed_at  FROM orders
 	                        WHERE user_id = $1 ORDER BY uploaded_at DESC`
 
-	selectOrdersProcessingDefault = `SELECT  order_id, user_id , status ,accrual , uploaded_at, changed_at  FROM orders
-	                                WHERE ( status='NEW' or status='REGISTERED' or status='PROCESSING' ) ORDER BY uploaded_at DESC`
-
-	selectOneOrderDefault = `SELECT  order_id, user_id , status ,accrual , uploaded_at, changed_at  FROM orders
+	selectOrdersPageDefault = `SELECT  order_id, user_id , status ,accrual , uploaded_at, changed_at  FROM orders
+	                        WHERE user_id = $1
+	                          AND ($2::order_status_type IS NULL OR status = $2)
+	                          AND ($3::timestamptz IS NULL OR uploaded_at >= $3)
+	                          AND ($4::timestamptz IS NULL OR uploaded_at < $4)
+	                          AND ($5::timestamptz IS NULL OR (uploaded_at, order_id) < ($5, $6))
+	                        ORDER BY uploaded_at DESC, order_id DESC LIMIT $7`
+
+	selectWithdrawalsPageDefault = `SELECT  user_id , order_id,  sum , processed_at FROM withdrawals
+	                        WHERE user_id = $1
+	                          AND ($2::timestamptz IS NULL OR processed_at >= $2)
+	                          AND ($3::timestamptz IS NULL OR processed_at < $3)
+	                          AND ($4::timestamptz IS NULL OR (processed_at, order_id) < ($4, $5))
+	                        ORDER BY processed_at DESC, order_id DESC LIMIT $6`
+
+	queryClaimOrdersDefault = `WITH claim AS (
+			SELECT order_id FROM orders
+			WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND stale_at IS NULL AND dead_at IS NULL
+			      AND next_attempt_at <= now()
+			      AND (leased_until IS NULL OR leased_until < now())
+			ORDER BY next_attempt_at, uploaded_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE orders o SET leased_until = now() + make_interval(secs => $2) , attempts = o.attempts + 1
+		FROM claim WHERE o.order_id = claim.order_id
+		RETURNING o.order_id, o.user_id , o.status ,o.accrual , o.uploaded_at, o.changed_at ,
+		          o.attempts , o.failures , o.next_attempt_at , o.leased_until`
+
+	queryReleaseOrdersDefault = `UPDATE orders SET leased_until = NULL WHERE order_id = ANY($1)`
+
+	queryScheduleOrdersDefault = `UPDATE orders o SET leased_until = NULL , next_attempt_at = s.next_at ,
+		attempts = s.attempts , failures = s.failures , stale_at = CASE WHEN s.stale THEN now() END ,
+		dead_at = CASE WHEN s.dead THEN now() END , last_error = NULLIF(s.last_error, '') ,
+		accrual_provider = COALESCE(NULLIF(s.provider, ''), o.accrual_provider)
+		FROM UNNEST($1::bigint[], $2::timestamptz[], $3::integer[], $4::integer[], $5::boolean[], $6::boolean[],
+		            $7::text[], $8::text[])
+		     AS s(order_id, next_at, attempts, failures, stale, dead, last_error, provider)
+		WHERE o.order_id = s.order_id`
+
+	selectDeadOrdersDefault = `SELECT order_id, user_id , status , accrual , uploaded_at , changed_at ,
+		attempts , failures , next_attempt_at , stale_at , dead_at , COALESCE(last_error, '')
+		FROM orders WHERE dead_at IS NOT NULL OR stale_at IS NOT NULL
+		ORDER BY COALESCE(dead_at, stale_at) DESC, order_id DESC LIMIT $1`
+
+	queryRequeueOrdersDefault = `UPDATE orders SET dead_at = NULL , stale_at = NULL , last_error = NULL ,
+		attempts = 0 , failures = 0 , next_attempt_at = now() , leased_until = NULL
+		WHERE order_id = ANY($1) AND (dead_at IS NOT NULL OR stale_at IS NOT NULL)`
+
+	queryInsertAnomaliesDefault = `INSERT INTO accrual_anomalies (order_id , provider , reason , payload , created_at)
+		SELECT a.order_id, NULLIF(a.provider, ''), a.reason, a.payload, now()
+		FROM UNNEST($1::bigint[], $2::text[], $3::text[], $4::bytea[]) AS a(order_id, provider, reason, payload)`
+
+	selectAnomaliesDefault = `SELECT anomaly_id , order_id , COALESCE(provider, '') , reason , payload , created_at
+		FROM accrual_anomalies ORDER BY created_at DESC, anomaly_id DESC LIMIT $1`
+
+	selectOneOrderDefault = `SELECT  order_id, user_id , status ,accrual , uploaded_at, changed_at ,
+	                                COALESCE(accrual_provider, '') FROM orders
 	                                WHERE order_id = $1`
 
-	selectBalanceDefault = `SELECT user_id , current ,withdrawn, changed_at  FROM balances WHERE user_id = $1`
+	selectLedgerBalanceDefault = `SELECT user_id ,
+		COALESCE(SUM(CASE WHEN entry_type = 'CREDIT' THEN amount ELSE -amount END), 0) ,
+		COALESCE(SUM(CASE WHEN entry_type = 'DEBIT' THEN amount ELSE 0 END), 0) ,
+		MAX(created_at) FROM ledger_entries WHERE user_id = $1 GROUP BY user_id`
+
+	selectLedgerDefault = `SELECT entry_id, user_id , entry_type , amount , COALESCE(order_id, withdrawal_id) , created_at
+	                        FROM ledger_entries WHERE user_id = $1 ORDER BY created_at DESC, entry_id DESC`
+
+	queryLedgerDebitDefault = `INSERT INTO ledger_entries (user_id , entry_type , amount , withdrawal_id , created_at)
+	       VALUES ($1, 'DEBIT', $2, $3, now())`
 
 	selectWithdrawalsDefault = `SELECT  user_id , order_id,  sum , processed_at FROM withdrawals
 	                                 WHERE user_id = $1`
@@ -131,78 +210,92 @@ const (
 	queryInsertWithdrawDefault = `INSERT INTO withdrawals ( user_id, order_id ,sum , processed_at)
 	       VALUES ($1,$2, $3 ,now()) RETURNING user_id, order_id ,sum , processed_at`
 
-	queryBalanceDecDefault = `INSERT INTO balances (user_id , current ,withdrawn, changed_at) VALUES ($1,$2,$3,now())
-		    ON CONFLICT (user_id) 
-		DO UPDATE SET current=balances.current-excluded.current,
-		              withdrawn=balances.withdrawn+excluded.withdrawn  , changed_at = now() 
+	queryBalanceDecDefault = `UPDATE balances SET current = current - $2 , withdrawn = withdrawn + $2 , changed_at = now()
+		WHERE user_id = $1 AND current >= $2
 		RETURNING user_id , current ,withdrawn, changed_at`
 
-	queryBalanceIncDefault = `INSERT INTO balances (user_id , current ,withdrawn, changed_at) VALUES ($1,$2,$3,now())
-		ON CONFLICT (user_id) 
-	DO UPDATE SET current=balances.current+excluded.current , changed_at = now() 
-	RETURNING user_id , current ,withdrawn, changed_at`
-
-	queryCOrderDefault = `UPDATE orders SET status = $2  , accrual = $3 , changed_at = now() WHERE order_id = $1
-			   RETURNING order_id, user_id , status ,accrual`
+	// queryCOrderDefault moves an order to a new status, appends the change to
+	// its history and credits the accrual only on the transition into
+	// PROCESSED, so replaying an update is a no-op.
+	queryCOrderDefault = `WITH upd AS (
+			UPDATE orders SET status = $2 , accrual = $3 , changed_at = now()
+			WHERE order_id = $1 AND status NOT IN ('PROCESSED', 'INVALID') AND status <> $2
+			RETURNING order_id, user_id , status ,accrual , changed_at
+		), hist AS (
+			INSERT INTO order_status_history (order_id , status , accrual , changed_at)
+			SELECT order_id, status, accrual, changed_at FROM upd
+		), led AS (
+			INSERT INTO ledger_entries (user_id , entry_type , amount , order_id , created_at)
+			SELECT user_id, 'CREDIT', accrual, order_id, now() FROM upd
+			WHERE status = 'PROCESSED' AND accrual > 0
+			ON CONFLICT DO NOTHING
+			RETURNING user_id , amount
+		)
+		INSERT INTO balances (user_id , current ,withdrawn, changed_at)
+		SELECT user_id, amount, 0, now() FROM led
+		ON CONFLICT (user_id)
+		DO UPDATE SET current=balances.current+excluded.current , changed_at = now()`
 )
 
-func (s *PgStore) InsertWithdraw(ctx context.Context, w store.Withdraw) error {
-	conn, err := s.pool.Acquire(ctx)
-	if err != nil {
-		return fmt.Errorf("acquire connection: %w", err)
-	}
-	defer conn.Release()
+func retryTxTimes() []int {
+	return []int{10, 50, 100, 250}
+}
 
-	tx, err := conn.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("error begin tx: %w", err)
-	}
+// inTx runs fn in a transaction and retries the whole transaction
+// on serialization failures and deadlocks.
+func (s *PgStore) inTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	return utils.RetryAction(ctx, retryTxTimes(), func(ctx context.Context) error {
+		conn, err := s.pool.Acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("acquire connection: %w", err)
+		}
+		defer conn.Release()
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("error begin tx: %w", err)
+		}
 
-	defer func() {
 		defer func() { _ = tx.Rollback(ctx) }()
-	}()
 
-	row := tx.QueryRow(ctx, selectBalanceDefault, w.UserID)
-	var o store.Balance
-	if row != nil {
-		_ = row.Scan(&o.UserID, &o.Accrual, &o.Withdrawn, &o.TimeC)
-	}
-	s.l.Logger.Debug("select ", zap.Any("balance", o))
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}, ProbePGSerialization)
+}
 
-	if o.Accrual.Compare(w.Sum) < 0 {
-		return ErrBalanceNotEnough
-	}
+func (s *PgStore) InsertWithdraw(ctx context.Context, w store.Withdraw) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.insertWithdrawTx(ctx, tx, w)
+	})
+}
 
-	row = tx.QueryRow(ctx, queryBalanceDecDefault, w.UserID, w.Sum, w.Sum)
-	if row != nil {
-		var u store.Balance
-		err := row.Scan(&u.UserID, &u.Accrual, &u.Withdrawn, &u.TimeC)
-		if err != nil {
-			if ProbePGDublicate(err) {
-				return ErrAlreadyExists
-			}
-			return err
+func (s *PgStore) insertWithdrawTx(ctx context.Context, tx pgx.Tx, w store.Withdraw) error {
+	var b store.Balance
+	err := tx.QueryRow(ctx, queryBalanceDecDefault, w.UserID, w.Sum).Scan(&b.UserID, &b.Accrual, &b.Withdrawn, &b.TimeC)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || ProbePGErrorConstrain(err) {
+			return ErrBalanceNotEnough
 		}
-		s.l.Logger.Debug("insert", zap.Any("new balance", u))
-	} else {
-		return ErrRowNotFound
+		return err
 	}
+	s.l.Logger.Debug("withdraw", zap.Any("new balance", b))
 
-	rowW := tx.QueryRow(ctx, queryInsertWithdrawDefault, w.UserID, w.OrderID, w.Sum)
-	if rowW != nil {
-		var u store.Withdraw
-		err := rowW.Scan(&u.UserID, &u.OrderID, &u.Sum, &u.TimeC)
-		if err != nil {
-			if ProbePGDublicate(err) {
-				return ErrAlreadyExists
-			}
-			return err
+	var u store.Withdraw
+	err = tx.QueryRow(ctx, queryInsertWithdrawDefault, w.UserID, w.OrderID, w.Sum).Scan(&u.UserID, &u.OrderID, &u.Sum, &u.TimeC)
+	if err != nil {
+		if ProbePGDublicate(err) {
+			return ErrAlreadyExists
 		}
-		s.l.Logger.Debug("insert ", zap.Any("withdraw", u))
-	} else {
-		return ErrRowNotFound
+		return err
+	}
+	s.l.Logger.Debug("insert ", zap.Any("withdraw", u))
+
+	if _, err := tx.Exec(ctx, queryLedgerDebitDefault, w.UserID, w.Sum, w.OrderID); err != nil {
+		return fmt.Errorf("insert ledger debit: %w", err)
 	}
-	return tx.Commit(ctx)
+	return nil
 }
 
 func (s *PgStore) InsertOrder(ctx context.Context, o store.Order) error {
@@ -226,8 +319,11 @@ func (s *PgStore) GetOneOrder(ctx context.Context, id uint64) (store.Order, erro
 	row := s.pool.QueryRow(ctx, selectOneOrderDefault, id)
 	var o store.Order
 	if row != nil {
-		err := row.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC)
+		err := row.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC, &o.Provider)
 		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return o, ErrRowNotFound
+			}
 			return o, err
 		}
 	} else {
@@ -236,8 +332,30 @@ func (s *PgStore) GetOneOrder(ctx context.Context, id uint64) (store.Order, erro
 	return o, nil
 }
 
+func (s *PgStore) GetOrderHistory(ctx context.Context, id uint64) ([]store.OrderStatus, error) {
+	rows, err := s.pool.Query(ctx, selectOrderHistoryDefault, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hist := make([]store.OrderStatus, 0, defaultSliceCap)
+	for rows.Next() {
+		var h store.OrderStatus
+		err := rows.Scan(&h.OrderID, &h.Status, &h.Accrual, &h.TimeC)
+		if err != nil {
+			return nil, err
+		}
+		hist = append(hist, h)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
 func (s *PgStore) GetBalance(ctx context.Context, id uint64) (store.Balance, error) {
-	row := s.pool.QueryRow(ctx, selectBalanceDefault, id)
+	row := s.pool.QueryRow(ctx, selectLedgerBalanceDefault, id)
 	var o store.Balance
 	if row != nil {
 		err := row.Scan(&o.UserID, &o.Accrual, &o.Withdrawn, &o.TimeC)
@@ -279,6 +397,28 @@ func (s *PgStore) GetWithdrawals(ctx context.Context, id uint64) ([]store.Withdr
 	return withs, nil
 }
 
+func (s *PgStore) GetLedger(ctx context.Context, id uint64) ([]store.LedgerEntry, error) {
+	rows, err := s.pool.Query(ctx, selectLedgerDefault, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]store.LedgerEntry, 0, defaultSliceCap)
+	for rows.Next() {
+		var e store.LedgerEntry
+		err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Amount, &e.OrderID, &e.TimeC)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
 func (s *PgStore) GetOrders(ctx context.Context, id uint64) ([]store.Order, error) {
 	rows, err := s.pool.Query(ctx, selectOrdersDefault, id)
 	if err != nil {
@@ -301,6 +441,66 @@ func (s *PgStore) GetOrders(ctx context.Context, id uint64) ([]store.Order, erro
 	return ores, nil
 }
 
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func nullString(v string) any {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+func (s *PgStore) GetOrdersPage(ctx context.Context, f store.PageFilter) ([]store.Order, error) {
+	rows, err := s.pool.Query(ctx, selectOrdersPageDefault, f.UserID, nullString(f.Status),
+		nullTime(f.From), nullTime(f.To), nullTime(f.CursorTime), int64(f.CursorID), f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ores := make([]store.Order, 0, f.Limit)
+	for rows.Next() {
+		var o store.Order
+		err := rows.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC)
+		if err != nil {
+			return nil, err
+		}
+		ores = append(ores, o)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return ores, nil
+}
+
+func (s *PgStore) GetWithdrawalsPage(ctx context.Context, f store.PageFilter) ([]store.Withdraw, error) {
+	rows, err := s.pool.Query(ctx, selectWithdrawalsPageDefault, f.UserID,
+		nullTime(f.From), nullTime(f.To), nullTime(f.CursorTime), int64(f.CursorID), f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	withs := make([]store.Withdraw, 0, f.Limit)
+	for rows.Next() {
+		var o store.Withdraw
+		err := rows.Scan(&o.UserID, &o.OrderID, &o.Sum, &o.TimeC)
+		if err != nil {
+			return nil, err
+		}
+		withs = append(withs, o)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return withs, nil
+}
+
 func (s *PgStore) AddUser(ctx context.Context, u store.User) (store.User, error) {
 	row := s.pool.QueryRow(ctx, queryDefault, u.Name, u.Password)
 	if row != nil {
@@ -330,8 +530,74 @@ func (s *PgStore) GetUser(ctx context.Context, u store.User) (store.User, error)
 	return u, nil
 }
 
-func (s *PgStore) GetOrdersForProcessing(ctx context.Context) ([]store.Order, error) {
-	rows, err := s.pool.Query(ctx, selectOrdersProcessingDefault)
+// ClaimOrdersForProcessing leases up to limit due orders to the caller.
+// Rows locked by another replica are skipped, so concurrent pollers
+// never receive the same order.
+func (s *PgStore) ClaimOrdersForProcessing(ctx context.Context, limit int, lease time.Duration) ([]store.Order, error) {
+	rows, err := s.pool.Query(ctx, queryClaimOrdersDefault, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ores := make([]store.Order, 0, limit)
+	for rows.Next() {
+		var o store.Order
+		err := rows.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC,
+			&o.Attempts, &o.Failures, &o.NextAttempt, &o.LeasedUntil)
+		if err != nil {
+			return nil, err
+		}
+		ores = append(ores, o)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return ores, nil
+}
+
+func (s *PgStore) ReleaseOrders(ctx context.Context, ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]int64, len(ids))
+	for i, id := range ids {
+		args[i] = int64(id)
+	}
+	_, err := s.pool.Exec(ctx, queryReleaseOrdersDefault, args)
+	return err
+}
+
+func (s *PgStore) ScheduleOrders(ctx context.Context, sched []store.OrderSchedule) error {
+	if len(sched) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(sched))
+	nextAt := make([]time.Time, len(sched))
+	attempts := make([]int32, len(sched))
+	failures := make([]int32, len(sched))
+	stale := make([]bool, len(sched))
+	dead := make([]bool, len(sched))
+	lastErr := make([]string, len(sched))
+	provider := make([]string, len(sched))
+	for i := range sched {
+		ids[i] = int64(sched[i].OrderID)
+		nextAt[i] = sched[i].NextAttempt
+		attempts[i] = int32(sched[i].Attempts)
+		failures[i] = int32(sched[i].Failures)
+		stale[i] = sched[i].Stale
+		dead[i] = sched[i].Dead
+		lastErr[i] = sched[i].LastError
+		provider[i] = sched[i].Provider
+	}
+	_, err := s.pool.Exec(ctx, queryScheduleOrdersDefault, ids, nextAt, attempts, failures, stale, dead, lastErr, provider)
+	return err
+}
+
+// GetDeadOrders returns orders that are not polled anymore, dead or stale,
+// most recent first.
+func (s *PgStore) GetDeadOrders(ctx context.Context, limit int) ([]store.Order, error) {
+	rows, err := s.pool.Query(ctx, selectDeadOrdersDefault, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -339,10 +605,18 @@ func (s *PgStore) GetOrdersForProcessing(ctx context.Context) ([]store.Order, er
 	ores := make([]store.Order, 0, defaultSliceCap)
 	for rows.Next() {
 		var o store.Order
-		err := rows.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC)
+		var staleAt, deadAt *time.Time
+		err := rows.Scan(&o.OrderID, &o.UserID, &o.Status, &o.Accrual, &o.TimeU, &o.TimeC,
+			&o.Attempts, &o.Failures, &o.NextAttempt, &staleAt, &deadAt, &o.LastError)
 		if err != nil {
 			return nil, err
 		}
+		if staleAt != nil {
+			o.StaleAt = *staleAt
+		}
+		if deadAt != nil {
+			o.DeadAt = *deadAt
+		}
 		ores = append(ores, o)
 	}
 	err = rows.Err()
@@ -352,22 +626,72 @@ func (s *PgStore) GetOrdersForProcessing(ctx context.Context) ([]store.Order, er
 	return ores, nil
 }
 
-func (s *PgStore) UpdateOrdersBalancesBatch(ctx context.Context, orders []store.Order) error {
-	conn, err := s.pool.Acquire(ctx)
+// RequeueOrders puts dead and stale orders back to polling and returns
+// how many were requeued.
+func (s *PgStore) RequeueOrders(ctx context.Context, ids []uint64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := make([]int64, len(ids))
+	for i, id := range ids {
+		args[i] = int64(id)
+	}
+	tag, err := s.pool.Exec(ctx, queryRequeueOrdersDefault, args)
 	if err != nil {
-		return fmt.Errorf("acquire connection: %w", err)
+		return 0, err
 	}
-	defer conn.Release()
+	return int(tag.RowsAffected()), nil
+}
 
-	tx, err := conn.Begin(ctx)
+// InsertAnomalies quarantines accrual responses that failed validation.
+func (s *PgStore) InsertAnomalies(ctx context.Context, anomalies []store.Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(anomalies))
+	provider := make([]string, len(anomalies))
+	reason := make([]string, len(anomalies))
+	payload := make([][]byte, len(anomalies))
+	for i := range anomalies {
+		ids[i] = int64(anomalies[i].OrderID)
+		provider[i] = anomalies[i].Provider
+		reason[i] = anomalies[i].Reason
+		payload[i] = anomalies[i].Payload
+	}
+	_, err := s.pool.Exec(ctx, queryInsertAnomaliesDefault, ids, provider, reason, payload)
+	return err
+}
+
+// GetAnomalies returns quarantined accrual responses, most recent first.
+func (s *PgStore) GetAnomalies(ctx context.Context, limit int) ([]store.Anomaly, error) {
+	rows, err := s.pool.Query(ctx, selectAnomaliesDefault, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]store.Anomaly, 0, defaultSliceCap)
+	for rows.Next() {
+		var a store.Anomaly
+		err := rows.Scan(&a.ID, &a.OrderID, &a.Provider, &a.Reason, &a.Payload, &a.TimeC)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	err = rows.Err()
 	if err != nil {
-		return fmt.Errorf("error begin tx: %w", err)
+		return nil, err
 	}
+	return res, nil
+}
 
-	defer func() {
-		defer func() { _ = tx.Rollback(ctx) }()
-	}()
+func (s *PgStore) UpdateOrdersBalancesBatch(ctx context.Context, orders []store.Order) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.updateOrdersBalancesTx(ctx, tx, orders)
+	})
+}
 
+func (s *PgStore) updateOrdersBalancesTx(ctx context.Context, tx pgx.Tx, orders []store.Order) error {
 	var indexLimit int
 	if s.limitbatch != 0 && len(orders) > s.limitbatch {
 		indexLimit = s.limitbatch
@@ -385,17 +709,95 @@ func (s *PgStore) UpdateOrdersBalancesBatch(ctx context.Context, orders []store.
 			batch.Queue(queryCOrderDefault, orders[i+index].OrderID, orders[i+index].Status, orders[i+index].Accrual)
 		}
 
-		for i := 0; i < indexLimit; i++ {
-			batch.Queue(queryBalanceIncDefault, orders[i+index].UserID, orders[i+index].Accrual, 0)
-		}
-
 		br := tx.SendBatch(ctx, batch)
 
 		if e := br.Close(); e != nil {
 			return fmt.Errorf("closing batch result: %w", e)
 		}
 	}
-	return tx.Commit(ctx)
+	return nil
+}
+
+const (
+	queryReserveIdempotencyDefault = `INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at) VALUES ($1, $2, $3, now())
+		ON CONFLICT (user_id, key) DO NOTHING RETURNING created_at`
+
+	selectIdempotencyDefault = `SELECT fingerprint, status_code, content_type, response, created_at FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	queryTakeOverIdempotencyDefault = `UPDATE idempotency_keys SET created_at = now()
+		WHERE user_id = $1 AND key = $2 AND status_code = 0 AND created_at = $3`
+
+	queryCompleteIdempotencyDefault = `UPDATE idempotency_keys SET status_code = $3, content_type = $4, response = $5
+		WHERE user_id = $1 AND key = $2`
+
+	queryDeleteIdempotencyDefault = `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+
+	queryDeleteExpiredIdempotencyDefault = `DELETE FROM idempotency_keys WHERE created_at < $1`
+)
+
+// ReserveIdempotencyKey stores a new key. When the key is already taken the
+// stored record is returned with ErrAlreadyExists.
+func (s *PgStore) ReserveIdempotencyKey(ctx context.Context, k store.IdempotencyKey) (store.IdempotencyKey, error) {
+	err := s.pool.QueryRow(ctx, queryReserveIdempotencyDefault, k.UserID, k.Key, k.Fingerprint).Scan(&k.TimeC)
+	if err == nil {
+		return k, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return k, err
+	}
+
+	old := store.IdempotencyKey{UserID: k.UserID, Key: k.Key}
+	err = s.pool.QueryRow(ctx, selectIdempotencyDefault, k.UserID, k.Key).Scan(&old.Fingerprint, &old.StatusCode,
+		&old.ContentType, &old.Response, &old.TimeC)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// deleted between the two statements
+			return k, store.ErrConflict
+		}
+		return k, err
+	}
+	return old, ErrAlreadyExists
+}
+
+// TakeOverIdempotencyKey renews the reservation of an abandoned key. It
+// returns ErrConflict when the key was completed or taken over since k was
+// read.
+func (s *PgStore) TakeOverIdempotencyKey(ctx context.Context, k store.IdempotencyKey) error {
+	tag, err := s.pool.Exec(ctx, queryTakeOverIdempotencyDefault, k.UserID, k.Key, k.TimeC)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+func (s *PgStore) CompleteIdempotencyKey(ctx context.Context, k store.IdempotencyKey) error {
+	tag, err := s.pool.Exec(ctx, queryCompleteIdempotencyDefault, k.UserID, k.Key, k.StatusCode, k.ContentType, k.Response)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRowNotFound
+	}
+	return nil
+}
+
+func (s *PgStore) DeleteIdempotencyKey(ctx context.Context, userID uint64, key string) error {
+	_, err := s.pool.Exec(ctx, queryDeleteIdempotencyDefault, userID, key)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys removes the keys and stored responses
+// created before the cutoff.
+func (s *PgStore) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	tag, err := s.pool.Exec(ctx, queryDeleteExpiredIdempotencyDefault, before)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
 }
 
 func (s *PgStore) Close(ctx context.Context) {
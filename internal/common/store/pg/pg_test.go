@@ -0,0 +1,82 @@
+package pg_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/4aleksei/gmart/internal/common/store/pg"
+	"github.com/4aleksei/gmart/internal/gophermart/app"
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore connects to TEST_DATABASE_URI and applies migrations.
+// The test is skipped when the variable is not set.
+func newTestStore(t *testing.T) *pg.PgStore {
+	t.Helper()
+	uri := os.Getenv("TEST_DATABASE_URI")
+	if uri == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	require.NoError(t, app.RunMigrate([]string{"-d", uri, "-v", "error", "up"}))
+
+	l, err := logger.New(logger.Config{Level: "error"})
+	require.NoError(t, err)
+
+	s := pg.New(l)
+	s.DatabaseURI = uri
+	require.NoError(t, s.Start(context.Background()))
+	t.Cleanup(func() { _ = s.Stop(context.Background()) })
+	return s
+}
+
+func TestPgStore_ConcurrentWithdraw(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	base := uint64(time.Now().UnixNano() / 1000)
+	u, err := s.AddUser(ctx, store.User{Name: "concurrent" + strconv.FormatUint(base, 10), Password: "pass"})
+	require.NoError(t, err)
+
+	require.NoError(t, s.InsertOrder(ctx, store.Order{OrderID: base, UserID: u.ID, Status: "NEW", Accrual: decimal.Zero}))
+	require.NoError(t, s.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: base, UserID: u.ID, Status: "PROCESSED", Accrual: decimal.RequireFromString("100")},
+	}))
+
+	const workers = 50
+	var wg sync.WaitGroup
+	var success, notEnough atomic.Int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.InsertWithdraw(ctx, store.Withdraw{UserID: u.ID, OrderID: base + uint64(i) + 1, Sum: decimal.RequireFromString("10")})
+			switch {
+			case err == nil:
+				success.Add(1)
+			case errors.Is(err, pg.ErrBalanceNotEnough):
+				notEnough.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(10), success.Load())
+	assert.Equal(t, int64(workers-10), notEnough.Load())
+
+	b, err := s.GetBalance(ctx, u.ID)
+	require.NoError(t, err)
+	assert.True(t, b.Accrual.IsZero())
+	assert.True(t, decimal.RequireFromString("100").Equal(b.Withdrawn))
+}
@@ -8,7 +8,17 @@ import (
 	"github.com/greatcloak/decimal"
 )
 
-var ErrConflict = errors.New("data conflict")
+var (
+	ErrConflict         = errors.New("data conflict")
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrRowNotFound      = errors.New("not found")
+	ErrBalanceNotEnough = errors.New("balance not enough")
+)
+
+const (
+	LedgerCredit = "CREDIT"
+	LedgerDebit  = "DEBIT"
+)
 
 type Store interface {
 	AddUser(context.Context, User) (User, error)
@@ -17,12 +27,28 @@ type Store interface {
 	InsertOrder(context.Context, Order) error
 	InsertWithdraw(context.Context, Withdraw) error
 	GetOrders(context.Context, uint64) ([]Order, error)
+	GetOrdersPage(context.Context, PageFilter) ([]Order, error)
 	GetOneOrder(context.Context, uint64) (Order, error)
+	GetOrderHistory(context.Context, uint64) ([]OrderStatus, error)
 	GetBalance(context.Context, uint64) (Balance, error)
 	GetWithdrawals(context.Context, uint64) ([]Withdraw, error)
+	GetWithdrawalsPage(context.Context, PageFilter) ([]Withdraw, error)
+	GetLedger(context.Context, uint64) ([]LedgerEntry, error)
 
-	GetOrdersForProcessing(context.Context) ([]Order, error)
+	ClaimOrdersForProcessing(context.Context, int, time.Duration) ([]Order, error)
+	ReleaseOrders(context.Context, []uint64) error
+	ScheduleOrders(context.Context, []OrderSchedule) error
+	GetDeadOrders(context.Context, int) ([]Order, error)
+	RequeueOrders(context.Context, []uint64) (int, error)
 	UpdateOrdersBalancesBatch(context.Context, []Order) error
+	InsertAnomalies(context.Context, []Anomaly) error
+	GetAnomalies(context.Context, int) ([]Anomaly, error)
+
+	ReserveIdempotencyKey(context.Context, IdempotencyKey) (IdempotencyKey, error)
+	TakeOverIdempotencyKey(context.Context, IdempotencyKey) error
+	CompleteIdempotencyKey(context.Context, IdempotencyKey) error
+	DeleteIdempotencyKey(context.Context, uint64, string) error
+	DeleteExpiredIdempotencyKeys(context.Context, time.Time) (int, error)
 
 	Close(context.Context)
 	Ping(context.Context) error
@@ -42,6 +68,36 @@ type (
 		Accrual decimal.Decimal `db:"accrual"`
 		TimeU   time.Time       `db:"uploaded_at"`
 		TimeC   time.Time       `db:"changed_at"`
+
+		Attempts    int       `db:"attempts"`
+		Failures    int       `db:"failures"`
+		NextAttempt time.Time `db:"next_attempt_at"`
+		LeasedUntil time.Time `db:"leased_until"`
+		StaleAt     time.Time `db:"stale_at"`
+		DeadAt      time.Time `db:"dead_at"`
+		LastError   string    `db:"last_error"`
+		Provider    string    `db:"accrual_provider"`
+	}
+
+	// OrderSchedule releases the lease of a claimed order and sets when it
+	// is polled next. Stale and dead orders are not polled anymore until
+	// they are requeued.
+	OrderSchedule struct {
+		OrderID     uint64
+		Attempts    int
+		Failures    int
+		NextAttempt time.Time
+		Stale       bool
+		Dead        bool
+		LastError   string
+		Provider    string
+	}
+
+	OrderStatus struct {
+		OrderID uint64          `db:"order_id"`
+		Status  string          `db:"status"`
+		Accrual decimal.Decimal `db:"accrual"`
+		TimeC   time.Time       `db:"changed_at"`
 	}
 
 	Balance struct {
@@ -57,4 +113,49 @@ type (
 		Sum     decimal.Decimal `db:"sum"`
 		TimeC   time.Time       `db:"processed_at"`
 	}
+
+	// PageFilter selects one page of a user's history, newest first.
+	// Zero values mean "not set". The cursor is the (time, order_id) key of
+	// the last row of the previous page.
+	PageFilter struct {
+		UserID     uint64
+		Limit      int
+		Status     string
+		From       time.Time
+		To         time.Time
+		CursorTime time.Time
+		CursorID   uint64
+	}
+
+	LedgerEntry struct {
+		ID      uint64          `db:"entry_id"`
+		UserID  uint64          `db:"user_id"`
+		Type    string          `db:"entry_type"`
+		Amount  decimal.Decimal `db:"amount"`
+		OrderID uint64          `db:"order_id"`
+		TimeC   time.Time       `db:"created_at"`
+	}
+
+	// IdempotencyKey is a client supplied key of a mutating request and the
+	// response it produced. StatusCode is zero while the request is running.
+	IdempotencyKey struct {
+		UserID      uint64    `db:"user_id"`
+		Key         string    `db:"key"`
+		Fingerprint string    `db:"fingerprint"`
+		StatusCode  int       `db:"status_code"`
+		ContentType string    `db:"content_type"`
+		Response    []byte    `db:"response"`
+		TimeC       time.Time `db:"created_at"`
+	}
+
+	// Anomaly is a quarantined accrual response that failed validation,
+	// kept with its raw payload.
+	Anomaly struct {
+		ID       uint64    `db:"anomaly_id"`
+		OrderID  uint64    `db:"order_id"`
+		Provider string    `db:"provider"`
+		Reason   string    `db:"reason"`
+		Payload  []byte    `db:"payload"`
+		TimeC    time.Time `db:"created_at"`
+	}
 )
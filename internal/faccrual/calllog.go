@@ -0,0 +1,122 @@
+package faccrual
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCallLogSize = 10000
+
+type (
+	// Call is a request to the accrual API and its answer. Code is 0 for a
+	// dropped connection.
+	Call struct {
+		Time   time.Time `json:"time"`
+		Method string    `json:"method"`
+		Path   string    `json:"path"`
+		Order  string    `json:"order,omitempty"`
+		Code   int       `json:"code"`
+	}
+
+	callLog struct {
+		mu    sync.Mutex
+		calls []Call
+		size  int
+	}
+
+	statusWriter struct {
+		http.ResponseWriter
+		code int
+	}
+)
+
+func (c *callLog) add(call Call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.calls) >= c.size {
+		c.calls = c.calls[1:]
+	}
+	c.calls = append(c.calls, call)
+}
+
+func (c *callLog) list(order string) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]Call, 0, len(c.calls))
+	for _, v := range c.calls {
+		if order == "" || v.Order == order {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (c *callLog) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = nil
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets the chaos drop connections through the writer.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return hj.Hijack()
+}
+
+// withCallLog records the requests to the accrual API.
+func (s *Server) withCallLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/api/") {
+			next.ServeHTTP(res, req)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: res}
+		call := Call{Time: s.now(), Method: req.Method, Path: req.URL.Path}
+		if req.Method == http.MethodGet {
+			call.Order = strings.TrimPrefix(req.URL.Path, "/api/orders/")
+		}
+		defer func() {
+			call.Code = sw.code
+			s.calls.add(call)
+		}()
+		next.ServeHTTP(sw, req)
+	})
+}
+
+// Calls returns the logged requests, only of the order if it is set.
+func (s *Server) Calls(order string) []Call {
+	return s.calls.list(order)
+}
+
+func (s *Server) getCalls(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", applicationJSONContent)
+	_ = json.NewEncoder(res).Encode(s.Calls(req.URL.Query().Get("order")))
+}
+
+func (s *Server) deleteCalls(res http.ResponseWriter, req *http.Request) {
+	s.calls.reset()
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,288 @@
+package faccrual
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	latencyFixed   = "fixed"
+	latencyUniform = "uniform"
+	latencyExp     = "exp"
+
+	defaultRetryAfter = 60
+)
+
+var (
+	ErrBadLatency = errors.New("bad latency, want 100ms, 10ms-200ms or exp:100ms")
+	ErrBadChaos   = errors.New("bad chaos settings")
+)
+
+type (
+	// Chaos sets the probabilities of faults injected into answers of
+	// GET /api/orders/{number}. Latency is added before any answer.
+	Chaos struct {
+		TooManyRequests float64 `json:"too_many_requests"`
+		RetryAfter      int     `json:"retry_after"`
+		ServerError     float64 `json:"server_error"`
+		NoContent       float64 `json:"no_content"`
+		Malformed       float64 `json:"malformed"`
+		Truncated       float64 `json:"truncated"`
+		Drop            float64 `json:"drop"`
+		Latency         Latency `json:"latency"`
+	}
+
+	// Latency is a distribution of delays: fixed, uniform between Min and
+	// Max, or exponential with mean Min.
+	Latency struct {
+		Kind string
+		Min  time.Duration
+		Max  time.Duration
+	}
+
+	ChaosStats struct {
+		Chaos    Chaos            `json:"chaos"`
+		Injected map[string]int64 `json:"injected"`
+	}
+
+	chaosState struct {
+		mu       sync.Mutex
+		cfg      Chaos
+		rnd      *rand.Rand
+		injected map[string]int64
+	}
+)
+
+func newChaosState(c Chaos, seed uint64) *chaosState {
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	return &chaosState{
+		cfg:      c,
+		rnd:      rand.New(rand.NewPCG(seed, seed)),
+		injected: make(map[string]int64),
+	}
+}
+
+func (c Chaos) validate() error {
+	for _, p := range []float64{c.TooManyRequests, c.ServerError, c.NoContent, c.Malformed, c.Truncated, c.Drop} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%w: probability %v", ErrBadChaos, p)
+		}
+	}
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("%w: retry after %d", ErrBadChaos, c.RetryAfter)
+	}
+	return nil
+}
+
+// ParseLatency parses "100ms", "10ms-200ms" or "exp:100ms", empty means
+// no latency.
+func ParseLatency(s string) (Latency, error) {
+	switch {
+	case s == "" || s == "0":
+		return Latency{}, nil
+	case strings.HasPrefix(s, latencyExp+":"):
+		d, err := time.ParseDuration(strings.TrimPrefix(s, latencyExp+":"))
+		if err != nil || d < 0 {
+			return Latency{}, ErrBadLatency
+		}
+		return Latency{Kind: latencyExp, Min: d}, nil
+	case strings.Contains(s, "-"):
+		lo, hi, _ := strings.Cut(s, "-")
+		minD, err1 := time.ParseDuration(lo)
+		maxD, err2 := time.ParseDuration(hi)
+		if err1 != nil || err2 != nil || minD < 0 || maxD < minD {
+			return Latency{}, ErrBadLatency
+		}
+		return Latency{Kind: latencyUniform, Min: minD, Max: maxD}, nil
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return Latency{}, ErrBadLatency
+		}
+		return Latency{Kind: latencyFixed, Min: d}, nil
+	}
+}
+
+func (l Latency) String() string {
+	switch l.Kind {
+	case latencyFixed:
+		return l.Min.String()
+	case latencyUniform:
+		return l.Min.String() + "-" + l.Max.String()
+	case latencyExp:
+		return latencyExp + ":" + l.Min.String()
+	}
+	return ""
+}
+
+// Set implements flag.Value.
+func (l *Latency) Set(s string) error {
+	v, err := ParseLatency(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+func (l Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *Latency) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return l.Set(s)
+}
+
+func (l Latency) delay(rnd *rand.Rand) time.Duration {
+	switch l.Kind {
+	case latencyFixed:
+		return l.Min
+	case latencyUniform:
+		return l.Min + time.Duration(rnd.Int64N(int64(l.Max-l.Min)+1))
+	case latencyExp:
+		return time.Duration(rnd.ExpFloat64() * float64(l.Min))
+	}
+	return 0
+}
+
+func (c *chaosState) get() Chaos {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+func (c *chaosState) set(v Chaos) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = v
+	return nil
+}
+
+func (c *chaosState) stats() ChaosStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := ChaosStats{Chaos: c.cfg, Injected: make(map[string]int64, len(c.injected))}
+	for k, v := range c.injected {
+		res.Injected[k] = v
+	}
+	return res
+}
+
+// draw returns true with probability p and counts the fault.
+func (c *chaosState) draw(p float64, fault string) bool {
+	if p <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rnd.Float64() >= p {
+		return false
+	}
+	c.injected[fault]++
+	return true
+}
+
+func (c *chaosState) latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.cfg.Latency.delay(c.rnd)
+	if d > 0 {
+		c.injected["latency"]++
+	}
+	return d
+}
+
+// inject answers the request with a fault, or returns false to let it be
+// answered normally.
+func (s *Server) inject(res http.ResponseWriter, req *http.Request) bool {
+	c := s.chaos.get()
+	if d := s.chaos.latency(); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-req.Context().Done():
+			return true
+		case <-t.C:
+		}
+	}
+	switch {
+	case s.chaos.draw(c.Drop, "drop"):
+		if hj, ok := res.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				_ = conn.Close()
+				return true
+			}
+		}
+		panic(http.ErrAbortHandler)
+	case s.chaos.draw(c.TooManyRequests, "too_many_requests"):
+		retry := c.RetryAfter
+		if retry == 0 {
+			retry = defaultRetryAfter
+		}
+		s.writeTooMany(res, retry)
+		return true
+	case s.chaos.draw(c.ServerError, "server_error"):
+		http.Error(res, "Internal server error", http.StatusInternalServerError)
+		return true
+	case s.chaos.draw(c.NoContent, "no_content"):
+		res.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+// corrupt breaks a JSON body of the order answer.
+func (s *Server) corrupt(body []byte) []byte {
+	c := s.chaos.get()
+	switch {
+	case s.chaos.draw(c.Truncated, "truncated"):
+		return body[:len(body)/2]
+	case s.chaos.draw(c.Malformed, "malformed"):
+		return []byte(strings.NewReplacer(`"status":"`, `"status":`, `"order":"`, `"order":`).Replace(string(body)))
+	}
+	return body
+}
+
+// SetChaos replaces the injected faults at runtime.
+func (s *Server) SetChaos(c Chaos) error {
+	return s.chaos.set(c)
+}
+
+// ChaosStats returns the injected faults and how many were injected.
+func (s *Server) ChaosStats() ChaosStats {
+	return s.chaos.stats()
+}
+
+func (s *Server) getChaos(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", applicationJSONContent)
+	_ = json.NewEncoder(res).Encode(s.ChaosStats())
+}
+
+func (s *Server) putChaos(res http.ResponseWriter, req *http.Request) {
+	var c Chaos
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if err := s.SetChaos(c); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.l.Logger.Info("faccrual: chaos changed")
+	s.getChaos(res, req)
+}
@@ -0,0 +1,116 @@
+package faccrual
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLatency(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Latency
+		err  bool
+	}{
+		{in: "", want: Latency{}},
+		{in: "100ms", want: Latency{Kind: latencyFixed, Min: 100 * time.Millisecond}},
+		{in: "10ms-200ms", want: Latency{Kind: latencyUniform, Min: 10 * time.Millisecond, Max: 200 * time.Millisecond}},
+		{in: "exp:50ms", want: Latency{Kind: latencyExp, Min: 50 * time.Millisecond}},
+		{in: "200ms-10ms", err: true},
+		{in: "fast", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLatency(tt.in)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrBadLatency)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.in, got.String())
+		})
+	}
+}
+
+func TestServer_Chaos(t *testing.T) {
+	s, ts, _ := newTestServer(t, Config{})
+	require.NoError(t, s.AddReward(Reward{Match: "Bork", Reward: decimal.RequireFromString("100"), RewardType: RewardPoints}))
+	require.NoError(t, s.AddOrder(OrderRequest{Order: "79927398713", Goods: []Good{{Description: "Bork"}}}))
+	url := ts.URL + "/api/orders/79927398713"
+
+	tests := []struct {
+		name  string
+		chaos Chaos
+		check func(t *testing.T, resp *http.Response)
+	}{
+		{name: "429", chaos: Chaos{TooManyRequests: 1, RetryAfter: 7}, check: func(t *testing.T, resp *http.Response) {
+			assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+			assert.Equal(t, "7", resp.Header.Get("Retry-After"))
+		}},
+		{name: "500", chaos: Chaos{ServerError: 1}, check: func(t *testing.T, resp *http.Response) {
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		}},
+		{name: "204", chaos: Chaos{NoContent: 1}, check: func(t *testing.T, resp *http.Response) {
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}},
+		{name: "malformed", chaos: Chaos{Malformed: 1}, check: func(t *testing.T, resp *http.Response) {
+			var o OrderAccrual
+			assert.Error(t, json.NewDecoder(resp.Body).Decode(&o))
+		}},
+		{name: "truncated", chaos: Chaos{Truncated: 1}, check: func(t *testing.T, resp *http.Response) {
+			var o OrderAccrual
+			assert.Error(t, json.NewDecoder(resp.Body).Decode(&o))
+		}},
+		{name: "latency", chaos: Chaos{Latency: Latency{Kind: latencyFixed, Min: 50 * time.Millisecond}}, check: func(t *testing.T, resp *http.Response) {
+			var o OrderAccrual
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&o))
+			assert.Equal(t, StatusProcessed, o.Status)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.chaos)
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/chaos", strings.NewReader(string(body)))
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			start := time.Now()
+			resp, err = http.Get(url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			tt.check(t, resp)
+			if tt.chaos.Latency.Min > 0 {
+				assert.GreaterOrEqual(t, time.Since(start), tt.chaos.Latency.Min)
+			}
+		})
+	}
+
+	require.NoError(t, s.chaos.set(Chaos{Drop: 1}))
+	// no keep-alive, a dropped reused connection is retried by the client
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	_, err := client.Get(url)
+	assert.Error(t, err)
+
+	st := s.chaos.stats()
+	for _, fault := range []string{"too_many_requests", "server_error", "no_content", "malformed", "truncated", "latency", "drop"} {
+		assert.Equal(t, int64(1), st.Injected[fault], fault)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/chaos", strings.NewReader(`{"server_error":2}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,106 @@
+package faccrual
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config sets the timeline of orders, the request limit and the injected
+// faults of the simulator. An order is REGISTERED for Registered after
+// upload, then PROCESSING for Processing, then PROCESSED or INVALID.
+type Config struct {
+	Address    string
+	Level      string
+	Registered time.Duration
+	Processing time.Duration
+	RPM        int64
+	Chaos      Chaos
+	Seed       uint64
+	Scenario   string
+	Mode       string
+	Upstream   string
+	RecordFile string
+}
+
+var ErrBadMode = errors.New("unknown mode")
+
+const (
+	addressDefault    string        = ":8100"
+	levelDefault      string        = "info"
+	registeredDefault time.Duration = time.Second
+	processingDefault time.Duration = 2 * time.Second
+	rpmDefault        int64         = 0
+	modeDefault       string        = ModeSimulate
+	recordFileDefault string        = "faccrual-record.jsonl"
+)
+
+// DefaultConfig returns the settings used without flags.
+func DefaultConfig() Config {
+	return Config{
+		Address:    addressDefault,
+		Level:      levelDefault,
+		Registered: registeredDefault,
+		Processing: processingDefault,
+		RPM:        rpmDefault,
+		Mode:       modeDefault,
+		RecordFile: recordFileDefault,
+	}
+}
+
+// GetConfig parses the flags of the faccrual command with the args.
+func GetConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("faccrual", flag.ContinueOnError)
+	fs.StringVar(&cfg.Address, "a", addressDefault, "address and port to run accrual simulator")
+	fs.StringVar(&cfg.Level, "v", levelDefault, "level of logging")
+	fs.DurationVar(&cfg.Registered, "registered", registeredDefault, "time an order stays REGISTERED")
+	fs.DurationVar(&cfg.Processing, "processing", processingDefault, "time an order stays PROCESSING")
+	fs.Int64Var(&cfg.RPM, "rpm", rpmDefault, "max GET requests per minute, 0 - no limit")
+	fs.Float64Var(&cfg.Chaos.TooManyRequests, "p429", 0, "probability of 429 answers")
+	fs.IntVar(&cfg.Chaos.RetryAfter, "retry-after", defaultRetryAfter, "Retry-After seconds of injected 429 answers")
+	fs.Float64Var(&cfg.Chaos.ServerError, "p500", 0, "probability of 500 answers")
+	fs.Float64Var(&cfg.Chaos.NoContent, "p204", 0, "probability of 204 answers")
+	fs.Float64Var(&cfg.Chaos.Malformed, "pmalformed", 0, "probability of malformed JSON")
+	fs.Float64Var(&cfg.Chaos.Truncated, "ptruncated", 0, "probability of truncated JSON")
+	fs.Float64Var(&cfg.Chaos.Drop, "pdrop", 0, "probability of dropped connections")
+	fs.Var(&cfg.Chaos.Latency, "latency", "latency of answers: 100ms, 10ms-200ms or exp:100ms")
+	fs.StringVar(&cfg.Mode, "mode", modeDefault, "simulate, record - proxy to -upstream and save exchanges, replay - serve saved exchanges")
+	fs.StringVar(&cfg.Upstream, "upstream", "", "accrual system address proxied in record mode")
+	fs.StringVar(&cfg.RecordFile, "record-file", recordFileDefault, "file of recorded exchanges")
+	fs.StringVar(&cfg.Scenario, "scenario", "", "JSON or YAML file with answers per order")
+	fs.Uint64Var(&cfg.Seed, "seed", 0, "seed of injected faults, 0 - random")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Chaos.validate(); err != nil {
+		return cfg, err
+	}
+	switch cfg.Mode {
+	case ModeSimulate, ModeReplay:
+	case ModeRecord:
+		if cfg.Upstream == "" {
+			return cfg, ErrNoUpstream
+		}
+	default:
+		return cfg, fmt.Errorf("%w: %s", ErrBadMode, cfg.Mode)
+	}
+
+	if envRunAddr := os.Getenv("RUN_ADDRESS"); cfg.Address == addressDefault && envRunAddr != "" {
+		cfg.Address = envRunAddr
+	}
+
+	if envScenario := os.Getenv("ACCRUAL_SCENARIO"); cfg.Scenario == "" && envScenario != "" {
+		cfg.Scenario = envScenario
+	}
+
+	if envRPM := os.Getenv("ACCRUAL_RPM"); cfg.RPM == rpmDefault && envRPM != "" {
+		if v, err := strconv.ParseInt(envRPM, 10, 64); err == nil {
+			cfg.RPM = v
+		}
+	}
+	return cfg, nil
+}
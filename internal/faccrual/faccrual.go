@@ -0,0 +1,321 @@
+// Package faccrual simulates the accrual system for local runs and tests.
+// It keeps reward rules and orders in memory and moves every order through
+// REGISTERED, PROCESSING and then PROCESSED or INVALID on a fixed timeline.
+// Scenarios replace the timeline of single orders with fixed answers, chaos
+// settings inject faults, and the /admin API changes both at runtime and
+// shows the log of calls. In record mode it proxies a real accrual system
+// and saves the exchanges, in replay mode it serves them back.
+package faccrual
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/utils"
+	"github.com/greatcloak/decimal"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+	StatusInvalid    = "INVALID"
+
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+
+	applicationJSONContent string = "application/json"
+	textPlainContent       string = "text/plain"
+)
+
+var (
+	ErrBadRequest    = errors.New("bad request format")
+	ErrAlreadyExists = errors.New("already registered")
+)
+
+type (
+	// Reward is a rule for goods whose description contains Match: Reward
+	// percent of the price or Reward points.
+	Reward struct {
+		Match      string          `json:"match"`
+		Reward     decimal.Decimal `json:"reward"`
+		RewardType string          `json:"reward_type"`
+	}
+
+	Good struct {
+		Description string          `json:"description"`
+		Price       decimal.Decimal `json:"price"`
+	}
+
+	OrderRequest struct {
+		Order string `json:"order"`
+		Goods []Good `json:"goods"`
+	}
+
+	OrderAccrual struct {
+		Order   string           `json:"order"`
+		Status  string           `json:"status"`
+		Accrual *decimal.Decimal `json:"accrual,omitempty"`
+	}
+
+	order struct {
+		number   string
+		accrual  decimal.Decimal
+		invalid  bool
+		uploaded time.Time
+	}
+
+	Server struct {
+		cfg     Config
+		l       *logger.ZapLogger
+		mu      sync.Mutex
+		rewards []Reward
+		orders  map[string]*order
+		window  time.Time
+		count   int64
+		chaos   *chaosState
+		calls   *callLog
+		api     http.Handler
+
+		scenarios map[string]*scenarioState
+
+		now func() time.Time
+	}
+)
+
+func New(cfg Config, l *logger.ZapLogger) *Server {
+	decimal.MarshalJSONWithoutQuotes = true
+	return &Server{
+		cfg:    cfg,
+		l:      l,
+		orders: make(map[string]*order),
+		chaos:  newChaosState(cfg.Chaos, cfg.Seed),
+		calls:  &callLog{size: defaultCallLogSize},
+
+		scenarios: make(map[string]*scenarioState),
+
+		now: time.Now,
+	}
+}
+
+// UseAPI serves the accrual API with h, e.g. a Recorder or a Replayer,
+// instead of the simulator. The admin API stays.
+func (s *Server) UseAPI(h http.Handler) {
+	s.api = h
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.api != nil {
+		mux.Handle("/api/", s.api)
+	} else {
+		mux.HandleFunc("POST /api/goods", s.postGoods)
+		mux.HandleFunc("POST /api/orders", s.postOrder)
+		mux.HandleFunc("GET /api/orders/{number}", s.getOrder)
+	}
+	mux.HandleFunc("GET /admin/chaos", s.getChaos)
+	mux.HandleFunc("PUT /admin/chaos", s.putChaos)
+	mux.HandleFunc("PUT /admin/orders/{number}", s.putOrderScenario)
+	mux.HandleFunc("DELETE /admin/orders/{number}", s.deleteOrderScenario)
+	mux.HandleFunc("GET /admin/calls", s.getCalls)
+	mux.HandleFunc("DELETE /admin/calls", s.deleteCalls)
+	return s.withCallLog(mux)
+}
+
+// AddReward registers a reward rule, one per Match.
+func (s *Server) AddReward(r Reward) error {
+	if r.Match == "" || r.Reward.IsNegative() || (r.RewardType != RewardPercent && r.RewardType != RewardPoints) {
+		return ErrBadRequest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.rewards {
+		if v.Match == r.Match {
+			return ErrAlreadyExists
+		}
+	}
+	s.rewards = append(s.rewards, r)
+	return nil
+}
+
+// AddOrder registers an order for calculation. The accrual is calculated
+// with the rules known at registration, an order without rewarded goods
+// ends INVALID.
+func (s *Server) AddOrder(req OrderRequest) error {
+	number, err := strconv.ParseUint(req.Order, 10, 64)
+	if err != nil || !utils.ValidLuhn(number) {
+		return ErrBadRequest
+	}
+	for _, g := range req.Goods {
+		if g.Price.IsNegative() {
+			return ErrBadRequest
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orders[req.Order]; ok {
+		return ErrAlreadyExists
+	}
+	o := &order{number: req.Order, uploaded: s.now()}
+	matched := false
+	for _, g := range req.Goods {
+		if r, ok := s.match(g); ok {
+			matched = true
+			o.accrual = o.accrual.Add(reward(r, g))
+		}
+	}
+	o.invalid = !matched
+	o.accrual = o.accrual.Round(2)
+	s.orders[req.Order] = o
+	return nil
+}
+
+func (s *Server) match(g Good) (Reward, bool) {
+	for _, r := range s.rewards {
+		if strings.Contains(g.Description, r.Match) {
+			return r, true
+		}
+	}
+	return Reward{}, false
+}
+
+func reward(r Reward, g Good) decimal.Decimal {
+	if r.RewardType == RewardPoints {
+		return r.Reward
+	}
+	return g.Price.Mul(r.Reward).Div(decimal.NewFromInt(100))
+}
+
+// Order returns the state of the order at the current time.
+func (s *Server) Order(number string) (OrderAccrual, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[number]
+	if !ok {
+		return OrderAccrual{}, false
+	}
+	return o.state(s.now().Sub(o.uploaded), &s.cfg), true
+}
+
+func (o *order) state(elapsed time.Duration, cfg *Config) OrderAccrual {
+	res := OrderAccrual{Order: o.number}
+	switch {
+	case elapsed < cfg.Registered:
+		res.Status = StatusRegistered
+	case elapsed < cfg.Registered+cfg.Processing:
+		res.Status = StatusProcessing
+	case o.invalid:
+		res.Status = StatusInvalid
+	default:
+		res.Status = StatusProcessed
+		if o.accrual.IsPositive() {
+			accrual := o.accrual
+			res.Accrual = &accrual
+		}
+	}
+	return res
+}
+
+// allow counts a request in the current minute and, over the limit,
+// returns the seconds until the next minute.
+func (s *Server) allow() (bool, int) {
+	if s.cfg.RPM <= 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.window) >= time.Minute {
+		s.window = now
+		s.count = 0
+	}
+	s.count++
+	if s.count <= s.cfg.RPM {
+		return true, 0
+	}
+	return false, int(s.window.Add(time.Minute).Sub(now).Seconds()) + 1
+}
+
+func (s *Server) postGoods(res http.ResponseWriter, req *http.Request) {
+	var r Reward
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	s.writeAdd(res, s.AddReward(r), http.StatusOK)
+}
+
+func (s *Server) postOrder(res http.ResponseWriter, req *http.Request) {
+	var o OrderRequest
+	if err := json.NewDecoder(req.Body).Decode(&o); err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	s.writeAdd(res, s.AddOrder(o), http.StatusAccepted)
+}
+
+func (s *Server) writeAdd(res http.ResponseWriter, err error, status int) {
+	switch {
+	case err == nil:
+		res.WriteHeader(status)
+	case errors.Is(err, ErrBadRequest):
+		http.Error(res, "Bad request", http.StatusBadRequest)
+	case errors.Is(err, ErrAlreadyExists):
+		http.Error(res, "Already registered", http.StatusConflict)
+	default:
+		s.l.Logger.Debug("faccrual: add error", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) writeTooMany(res http.ResponseWriter, retry int) {
+	res.Header().Set("Content-Type", textPlainContent)
+	res.Header().Set("Retry-After", strconv.Itoa(retry))
+	res.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(res, "No more than %d requests per minute allowed\n", s.cfg.RPM)
+}
+
+func (s *Server) getOrder(res http.ResponseWriter, req *http.Request) {
+	if ok, retry := s.allow(); !ok {
+		s.writeTooMany(res, retry)
+		return
+	}
+	if s.inject(res, req) {
+		return
+	}
+	number := req.PathValue("number")
+	if st, ok := s.nextStep(number); ok {
+		s.l.Logger.Debug("faccrual: order scenario", zap.String("order", number), zap.Any("step", st))
+		s.writeStep(res, number, st)
+		return
+	}
+	o, ok := s.Order(number)
+	if !ok {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.l.Logger.Debug("faccrual: order", zap.String("order", number), zap.String("status", o.Status))
+	s.writeOrder(res, o)
+}
+
+func (s *Server) writeOrder(res http.ResponseWriter, o OrderAccrual) {
+	body, err := json.Marshal(o)
+	if err != nil {
+		s.l.Logger.Debug("faccrual: error encoding response", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", applicationJSONContent)
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write(s.corrupt(body)); err != nil {
+		s.l.Logger.Debug("faccrual: error writing response", zap.Error(err))
+	}
+}
@@ -0,0 +1,99 @@
+package faccrual
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, cfg Config) (*Server, *httptest.Server, *time.Time) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+	s := New(cfg, l)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts, &now
+}
+
+func post(t *testing.T, url, body string) int {
+	resp, err := http.Post(url, applicationJSONContent, strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func getOrder(t *testing.T, url string) (int, OrderAccrual, http.Header) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var o OrderAccrual
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&o))
+	}
+	return resp.StatusCode, o, resp.Header
+}
+
+func TestServer_Timeline(t *testing.T) {
+	_, ts, now := newTestServer(t, Config{Registered: time.Second, Processing: 2 * time.Second})
+
+	assert.Equal(t, http.StatusOK, post(t, ts.URL+"/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`))
+	assert.Equal(t, http.StatusOK, post(t, ts.URL+"/api/goods", `{"match":"Acme","reward":5,"reward_type":"pt"}`))
+	assert.Equal(t, http.StatusConflict, post(t, ts.URL+"/api/goods", `{"match":"Bork","reward":1,"reward_type":"pt"}`))
+	assert.Equal(t, http.StatusBadRequest, post(t, ts.URL+"/api/goods", `{"match":"X","reward":1,"reward_type":"x"}`))
+
+	assert.Equal(t, http.StatusAccepted, post(t, ts.URL+"/api/orders",
+		`{"order":"79927398713","goods":[{"description":"Чайник Bork","price":7000},{"description":"Acme tea","price":100},{"description":"Cup","price":50}]}`))
+	assert.Equal(t, http.StatusAccepted, post(t, ts.URL+"/api/orders",
+		`{"order":"5062821234567892","goods":[{"description":"Cup","price":50}]}`))
+	assert.Equal(t, http.StatusConflict, post(t, ts.URL+"/api/orders", `{"order":"79927398713","goods":[]}`))
+	assert.Equal(t, http.StatusBadRequest, post(t, ts.URL+"/api/orders", `{"order":"79927398710","goods":[]}`))
+
+	code, _, _ := getOrder(t, ts.URL+"/api/orders/2377225624")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, o, _ := getOrder(t, ts.URL+"/api/orders/79927398713")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusRegistered, o.Status)
+	assert.Nil(t, o.Accrual)
+
+	*now = now.Add(1500 * time.Millisecond)
+	_, o, _ = getOrder(t, ts.URL+"/api/orders/79927398713")
+	assert.Equal(t, StatusProcessing, o.Status)
+
+	*now = now.Add(2 * time.Second)
+	_, o, _ = getOrder(t, ts.URL+"/api/orders/79927398713")
+	assert.Equal(t, StatusProcessed, o.Status)
+	require.NotNil(t, o.Accrual)
+	assert.True(t, decimal.RequireFromString("705").Equal(*o.Accrual))
+
+	_, o, _ = getOrder(t, ts.URL+"/api/orders/5062821234567892")
+	assert.Equal(t, StatusInvalid, o.Status)
+	assert.Nil(t, o.Accrual)
+}
+
+func TestServer_RetryAfter(t *testing.T) {
+	_, ts, now := newTestServer(t, Config{RPM: 2})
+
+	for i := 0; i < 2; i++ {
+		code, _, _ := getOrder(t, ts.URL+"/api/orders/1")
+		assert.Equal(t, http.StatusNoContent, code)
+	}
+	*now = now.Add(20 * time.Second)
+	code, _, h := getOrder(t, ts.URL+"/api/orders/1")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "41", h.Get("Retry-After"))
+
+	*now = now.Add(time.Minute)
+	code, _, _ = getOrder(t, ts.URL+"/api/orders/1")
+	assert.Equal(t, http.StatusNoContent, code)
+}
@@ -0,0 +1,231 @@
+package faccrual
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	ModeSimulate = "simulate"
+	ModeRecord   = "record"
+	ModeReplay   = "replay"
+
+	maxRecordBody int64 = 1 << 20
+)
+
+var (
+	ErrNoUpstream = errors.New("record mode needs an upstream")
+	ErrBadRecord  = errors.New("bad record file")
+)
+
+// recordedHeaders are kept with recorded answers.
+var recordedHeaders = []string{"Content-Type", "Retry-After"}
+
+type (
+	// Exchange is a recorded request and the answer of the upstream. An
+	// upstream that did not answer has Error set instead of Code.
+	Exchange struct {
+		Time     time.Time         `json:"time"`
+		Method   string            `json:"method"`
+		Path     string            `json:"path"`
+		Request  string            `json:"request,omitempty"`
+		Code     int               `json:"code,omitempty"`
+		Header   map[string]string `json:"header,omitempty"`
+		Response string            `json:"response,omitempty"`
+		Error    string            `json:"error,omitempty"`
+	}
+
+	// Recorder proxies the accrual API to the upstream and writes every
+	// exchange as a JSON line.
+	Recorder struct {
+		upstream *url.URL
+		client   *http.Client
+		mu       sync.Mutex
+		enc      *json.Encoder
+		l        *logger.ZapLogger
+	}
+
+	// Replayer answers requests with recorded exchanges. Repeated requests
+	// get the recorded answers in order, the last one repeats.
+	Replayer struct {
+		mu        sync.Mutex
+		exchanges map[string][]Exchange
+		pos       map[string]int
+	}
+)
+
+func NewRecorder(upstream string, w io.Writer, l *logger.ZapLogger) (*Recorder, error) {
+	if upstream == "" {
+		return nil, ErrNoUpstream
+	}
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		upstream: u,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		enc:      json.NewEncoder(w),
+		l:        l,
+	}, nil
+}
+
+func (r *Recorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRecordBody))
+	if err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	ex := Exchange{Time: time.Now(), Method: req.Method, Path: req.URL.Path, Request: string(body)}
+
+	target := *r.upstream
+	target.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+	target.RawQuery = req.URL.RawQuery
+	up, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	up.Header = req.Header.Clone()
+
+	resp, err := r.client.Do(up)
+	if err == nil {
+		defer resp.Body.Close()
+		var respBody []byte
+		respBody, err = io.ReadAll(io.LimitReader(resp.Body, maxRecordBody))
+		ex.Code = resp.StatusCode
+		ex.Response = string(respBody)
+		ex.Header = make(map[string]string)
+		for _, k := range recordedHeaders {
+			if v := resp.Header.Get(k); v != "" {
+				ex.Header[k] = v
+			}
+		}
+	}
+	if err != nil {
+		ex.Code = 0
+		ex.Error = err.Error()
+	}
+	r.save(ex)
+
+	if ex.Error != "" {
+		r.l.Logger.Debug("faccrual: upstream error", zap.String("path", ex.Path), zap.Error(err))
+		http.Error(res, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	writeExchange(res, ex)
+}
+
+func (r *Recorder) save(ex Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(ex); err != nil {
+		r.l.Logger.Error("faccrual: error saving exchange", zap.Error(err))
+	}
+}
+
+func writeExchange(res http.ResponseWriter, ex Exchange) {
+	for k, v := range ex.Header {
+		res.Header().Set(k, v)
+	}
+	res.WriteHeader(ex.Code)
+	_, _ = io.WriteString(res, ex.Response)
+}
+
+// NewReplayer reads exchanges written by a Recorder.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{
+		exchanges: make(map[string][]Exchange),
+		pos:       make(map[string]int),
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), int(2*maxRecordBody))
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ex Exchange
+		if err := json.Unmarshal(line, &ex); err != nil {
+			return nil, errors.Join(ErrBadRecord, err)
+		}
+		key := exchangeKey(ex.Method, ex.Path, ex.Request)
+		p.exchanges[key] = append(p.exchanges[key], ex)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Join(ErrBadRecord, err)
+	}
+	return p, nil
+}
+
+func LoadReplay(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplayer(f)
+}
+
+// exchangeKey matches GET requests by path and others also by body.
+func exchangeKey(method, path, body string) string {
+	if method == http.MethodGet {
+		return method + " " + path
+	}
+	return method + " " + path + " " + body
+}
+
+func (p *Replayer) next(key string) (Exchange, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list, ok := p.exchanges[key]
+	if !ok {
+		return Exchange{}, false
+	}
+	i := p.pos[key]
+	if i < len(list)-1 {
+		p.pos[key] = i + 1
+	}
+	return list[i], true
+}
+
+func (p *Replayer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRecordBody))
+	if err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	ex, ok := p.next(exchangeKey(req.Method, req.URL.Path, string(body)))
+	switch {
+	case !ok && req.Method == http.MethodGet:
+		// not recorded orders are unknown to the accrual system
+		res.WriteHeader(http.StatusNoContent)
+	case !ok:
+		http.Error(res, "Not recorded", http.StatusNotFound)
+	case ex.Error != "":
+		if hj, ok := res.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				_ = conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	default:
+		writeExchange(res, ex)
+	}
+}
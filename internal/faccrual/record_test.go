@@ -0,0 +1,107 @@
+package faccrual
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type answer struct {
+	code       int
+	retryAfter string
+	body       string
+}
+
+func call(t *testing.T, client *http.Client, method, url, body string) (answer, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	if err != nil {
+		return answer{}, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return answer{code: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After"), body: string(b)}, nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	up, upTS, _ := newTestServer(t, Config{})
+	accrual := decimal.RequireFromString("10")
+	require.NoError(t, up.SetScenario(&Scenario{Orders: []OrderScenario{{Order: "79927398713", Steps: []Step{
+		{Code: http.StatusTooManyRequests, RetryAfter: 5},
+		{Status: StatusProcessed, Accrual: &accrual},
+	}}}}))
+
+	var rec bytes.Buffer
+	proxy, proxyTS, _ := newTestServer(t, Config{})
+	r, err := NewRecorder(upTS.URL, &rec, proxy.l)
+	require.NoError(t, err)
+	proxy.UseAPI(r)
+	proxyTS.Config.Handler = proxy.Handler()
+
+	requests := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/orders/79927398713", ""},
+		{http.MethodGet, "/api/orders/79927398713", ""},
+		{http.MethodPost, "/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`},
+		{http.MethodPost, "/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`},
+		{http.MethodGet, "/api/orders/2377225624", ""},
+	}
+	recorded := make([]answer, 0, len(requests))
+	for _, rq := range requests {
+		a, err := call(t, http.DefaultClient, rq.method, proxyTS.URL+rq.path, rq.body)
+		require.NoError(t, err)
+		recorded = append(recorded, a)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, recorded[0].code)
+	assert.Equal(t, "5", recorded[0].retryAfter)
+	assert.Equal(t, http.StatusOK, recorded[1].code)
+	assert.Equal(t, http.StatusOK, recorded[2].code)
+	assert.Equal(t, http.StatusConflict, recorded[3].code)
+	assert.Len(t, proxy.Calls(""), len(requests))
+
+	upTS.Close()
+	a, err := call(t, http.DefaultClient, http.MethodGet, proxyTS.URL+"/api/orders/5062821234567892", "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, a.code)
+
+	rep, err := NewReplayer(bytes.NewReader(rec.Bytes()))
+	require.NoError(t, err)
+	replay, replayTS, _ := newTestServer(t, Config{})
+	replay.UseAPI(rep)
+	replayTS.Config.Handler = replay.Handler()
+
+	for i, rq := range requests {
+		a, err := call(t, http.DefaultClient, rq.method, replayTS.URL+rq.path, rq.body)
+		require.NoError(t, err)
+		assert.Equal(t, recorded[i], a, "%s %s", rq.method, rq.path)
+	}
+	a, err = call(t, http.DefaultClient, http.MethodGet, replayTS.URL+"/api/orders/79927398713", "")
+	require.NoError(t, err)
+	assert.Equal(t, recorded[1], a)
+
+	a, err = call(t, http.DefaultClient, http.MethodGet, replayTS.URL+"/api/orders/4561261212345467", "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, a.code)
+	a, err = call(t, http.DefaultClient, http.MethodPost, replayTS.URL+"/api/orders", `{}`)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, a.code)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	_, err = call(t, client, http.MethodGet, replayTS.URL+"/api/orders/5062821234567892", "")
+	assert.Error(t, err)
+}
+
+func TestNewReplayer_Bad(t *testing.T) {
+	_, err := NewReplayer(strings.NewReader("{\n"))
+	assert.ErrorIs(t, err, ErrBadRecord)
+
+	_, err = NewRecorder("", io.Discard, nil)
+	assert.ErrorIs(t, err, ErrNoUpstream)
+}
@@ -0,0 +1,177 @@
+package faccrual
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/greatcloak/decimal"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrBadScenario = errors.New("bad scenario")
+)
+
+type (
+	// Step is one answer of a scenario, given Times times. With Code 0 or
+	// 200 it is a status with an optional accrual, other codes are answered
+	// as is, 429 with RetryAfter.
+	Step struct {
+		Status     string           `json:"status,omitempty"`
+		Accrual    *decimal.Decimal `json:"accrual,omitempty"`
+		Code       int              `json:"code,omitempty"`
+		RetryAfter int              `json:"retry_after,omitempty"`
+		Times      int              `json:"times,omitempty"`
+	}
+
+	// OrderScenario is the sequence of answers for the order. The last step
+	// repeats once the others are used up.
+	OrderScenario struct {
+		Order string `json:"order"`
+		Steps []Step `json:"steps"`
+	}
+
+	Scenario struct {
+		Orders []OrderScenario `json:"orders"`
+	}
+
+	scenarioState struct {
+		steps  []Step
+		pos    int
+		served int
+	}
+)
+
+// LoadScenario reads a JSON or, by the .yaml or .yml extension, YAML file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		// YAML goes through JSON so both share the json tags.
+		var v any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadScenario, err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadScenario, err)
+		}
+	}
+	var sc Scenario
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadScenario, err)
+	}
+	for _, o := range sc.Orders {
+		if err := validateSteps(o.Steps); err != nil {
+			return nil, fmt.Errorf("order %s: %w", o.Order, err)
+		}
+	}
+	return &sc, nil
+}
+
+func validateSteps(steps []Step) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("%w: no steps", ErrBadScenario)
+	}
+	for _, st := range steps {
+		if st.Times < 0 || st.RetryAfter < 0 {
+			return fmt.Errorf("%w: negative times or retry_after", ErrBadScenario)
+		}
+		if st.Code != 0 && st.Code != http.StatusOK {
+			if st.Code < 100 || st.Code > 599 {
+				return fmt.Errorf("%w: code %d", ErrBadScenario, st.Code)
+			}
+			continue
+		}
+		switch st.Status {
+		case StatusRegistered, StatusProcessing, StatusProcessed, StatusInvalid:
+		default:
+			return fmt.Errorf("%w: status %q", ErrBadScenario, st.Status)
+		}
+	}
+	return nil
+}
+
+// SetScenario overrides the answers for the orders of the scenario.
+func (s *Server) SetScenario(sc *Scenario) error {
+	for _, o := range sc.Orders {
+		if err := validateSteps(o.Steps); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range sc.Orders {
+		s.scenarios[o.Order] = &scenarioState{steps: o.Steps}
+	}
+	return nil
+}
+
+// DeleteScenario returns the order to its timeline.
+func (s *Server) DeleteScenario(number string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scenarios, number)
+}
+
+// nextStep returns the current step of the order scenario and moves on.
+func (s *Server) nextStep(number string) (Step, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.scenarios[number]
+	if !ok {
+		return Step{}, false
+	}
+	st := sc.steps[sc.pos]
+	sc.served++
+	if sc.served >= max(st.Times, 1) && sc.pos < len(sc.steps)-1 {
+		sc.pos++
+		sc.served = 0
+	}
+	return st, true
+}
+
+func (s *Server) writeStep(res http.ResponseWriter, number string, st Step) {
+	switch st.Code {
+	case 0, http.StatusOK:
+		s.writeOrder(res, OrderAccrual{Order: number, Status: st.Status, Accrual: st.Accrual})
+	case http.StatusTooManyRequests:
+		retry := st.RetryAfter
+		if retry == 0 {
+			retry = defaultRetryAfter
+		}
+		s.writeTooMany(res, retry)
+	case http.StatusNoContent:
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(res, http.StatusText(st.Code), st.Code)
+	}
+}
+
+func (s *Server) putOrderScenario(res http.ResponseWriter, req *http.Request) {
+	sc := OrderScenario{Order: req.PathValue("number")}
+	if err := json.NewDecoder(req.Body).Decode(&sc); err != nil {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	sc.Order = req.PathValue("number")
+	if err := s.SetScenario(&Scenario{Orders: []OrderScenario{sc}}); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.l.Logger.Info("faccrual: order scenario set", zap.String("order", sc.Order), zap.Int("steps", len(sc.Steps)))
+	res.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteOrderScenario(res http.ResponseWriter, req *http.Request) {
+	s.DeleteScenario(req.PathValue("number"))
+	res.WriteHeader(http.StatusOK)
+}
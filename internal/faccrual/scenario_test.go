@@ -0,0 +1,91 @@
+package faccrual
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadScenario(t *testing.T) {
+	sc, err := LoadScenario("../../config/faccrual-scenario.example.yaml")
+	require.NoError(t, err)
+	require.Len(t, sc.Orders, 2)
+	assert.Equal(t, "79927398713", sc.Orders[0].Order)
+	require.Len(t, sc.Orders[0].Steps, 2)
+	assert.Equal(t, 2, sc.Orders[0].Steps[0].Times)
+	require.NotNil(t, sc.Orders[0].Steps[1].Accrual)
+	assert.True(t, decimal.RequireFromString("123.45").Equal(*sc.Orders[0].Steps[1].Accrual))
+	assert.Equal(t, 5, sc.Orders[1].Steps[0].RetryAfter)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scenario.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"orders":[{"order":"1","steps":[{"status":"DONE"}]}]}`), 0o600))
+	_, err = LoadScenario(path)
+	assert.ErrorIs(t, err, ErrBadScenario)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"orders":[{"order":"1","steps":[]}]}`), 0o600))
+	_, err = LoadScenario(path)
+	assert.ErrorIs(t, err, ErrBadScenario)
+}
+
+func TestServer_Scenario(t *testing.T) {
+	s, ts, _ := newTestServer(t, Config{})
+	sc, err := LoadScenario("../../config/faccrual-scenario.example.yaml")
+	require.NoError(t, err)
+	require.NoError(t, s.SetScenario(sc))
+
+	url := ts.URL + "/api/orders/79927398713"
+	for i := 0; i < 2; i++ {
+		code, o, _ := getOrder(t, url)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, StatusProcessing, o.Status)
+	}
+	for i := 0; i < 2; i++ {
+		_, o, _ := getOrder(t, url)
+		assert.Equal(t, StatusProcessed, o.Status)
+		require.NotNil(t, o.Accrual)
+		assert.True(t, decimal.RequireFromString("123.45").Equal(*o.Accrual))
+	}
+
+	other := ts.URL + "/api/orders/5062821234567892"
+	code, _, h := getOrder(t, other)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "5", h.Get("Retry-After"))
+	code, _, _ = getOrder(t, other)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	_, o, _ := getOrder(t, other)
+	assert.Equal(t, StatusInvalid, o.Status)
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/orders/5062821234567892",
+		strings.NewReader(`{"steps":[{"status":"PROCESSED","accrual":10}]}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, o, _ = getOrder(t, other)
+	assert.Equal(t, StatusProcessed, o.Status)
+
+	calls := s.Calls("5062821234567892")
+	require.Len(t, calls, 4)
+	codes := make([]int, 0, len(calls))
+	for _, c := range calls {
+		codes = append(codes, c.Code)
+	}
+	assert.Equal(t, []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusOK, http.StatusOK}, codes)
+	assert.Len(t, s.Calls(""), 8)
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/admin/orders/5062821234567892", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	code, _, _ = getOrder(t, other)
+	assert.Equal(t, http.StatusNoContent, code)
+}
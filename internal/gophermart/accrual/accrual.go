@@ -2,9 +2,13 @@ package accrual
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/4aleksei/gmart/internal/common/httpclientpool"
+	"github.com/4aleksei/gmart/internal/common/httpclientpool/job"
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/4aleksei/gmart/internal/common/store"
 	"github.com/4aleksei/gmart/internal/common/utils"
@@ -21,6 +25,29 @@ type (
 		s      *service.HandleService
 		wg     sync.WaitGroup
 		cancel context.CancelFunc
+		stats  pipelineStats
+	}
+
+	pipelineStats struct {
+		results      atomic.Int64
+		batches      atomic.Int64
+		backPressure atomic.Int64
+		anomalies    atomic.Int64
+		wakeups      atomic.Int64
+		lastFlushMs  atomic.Int64
+	}
+
+	// PipelineStats shows how results flow from the pool to the store.
+	// BackPressure counts results read from a full channel, that is while
+	// the workers were blocked by storing. Anomalies counts quarantined
+	// responses, Wakeups polls started early by new orders.
+	PipelineStats struct {
+		Results      int64 `json:"results"`
+		Batches      int64 `json:"batches"`
+		BackPressure int64 `json:"back_pressure"`
+		Anomalies    int64 `json:"anomalies"`
+		Wakeups      int64 `json:"wakeups"`
+		LastFlushMs  int64 `json:"last_flush_ms"`
 	}
 )
 
@@ -46,21 +73,39 @@ func (a *HandlersAccrual) Stop(ctx context.Context) error {
 	return nil
 }
 
+const defaultReleaseTimeout = 5 * time.Second
+
+func (a *HandlersAccrual) Stats() PipelineStats {
+	return PipelineStats{
+		Results:      a.stats.results.Load(),
+		Batches:      a.stats.batches.Load(),
+		BackPressure: a.stats.backPressure.Load(),
+		Anomalies:    a.stats.anomalies.Load(),
+		Wakeups:      a.stats.wakeups.Load(),
+		LastFlushMs:  a.stats.lastFlushMs.Load(),
+	}
+}
+
 func (a *HandlersAccrual) mainAccrual(ctx context.Context) {
 	defer a.wg.Done()
 
 	a.l.Logger.Info("Start Accrual client.")
 	var waitSec int64 = 0
 	for {
-		utils.SleepCancellable(ctx, time.Duration(a.cfg.PollInterval+waitSec)*time.Second)
+		a.waitPoll(ctx, time.Duration(a.cfg.PollInterval+waitSec)*time.Second, waitSec == 0)
 		select {
 		case <-ctx.Done():
 			return
 		default:
 			waitSec = 0
-			orders, err := a.s.GetOrdersForProcess(ctx)
+			if state, retryAt := a.s.AccrualState(); state == httpclientpool.StateOpen {
+				a.l.Logger.Debug("Accrual: circuit is open, skip poll", zap.Time("retry_at", retryAt))
+				waitSec = int64(time.Until(retryAt).Seconds())
+				continue
+			}
+			orders, err := a.s.ClaimOrdersForProcess(ctx, int(a.cfg.ClaimLimit), time.Duration(a.cfg.LeaseSec)*time.Second)
 			if err != nil {
-				a.l.Logger.Debug("Accrual: error request new orders ", zap.Error(err))
+				a.l.Logger.Debug("Accrual: error claim new orders ", zap.Error(err))
 				continue
 			}
 
@@ -70,36 +115,217 @@ func (a *HandlersAccrual) mainAccrual(ctx context.Context) {
 				continue
 			}
 
-			resOrders, w, err := a.s.SendOrdersToAccrual(ctx, orders)
-			if w > 0 {
-				waitSec = int64(w)
+			waitSec = a.processOrders(ctx, orders)
+		}
+	}
+}
+
+// waitPoll sleeps until the next poll. A registered order wakes it earlier
+// unless the accrual system asked to wait, signals within the debounce
+// window are merged into one poll.
+func (a *HandlersAccrual) waitPoll(ctx context.Context, d time.Duration, wakeable bool) {
+	var wake <-chan struct{}
+	if wakeable {
+		wake = a.s.NewOrders()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+		return
+	case <-wake:
+	}
+	a.stats.wakeups.Add(1)
+	utils.SleepCancellable(ctx, time.Duration(a.cfg.NotifyDebounceMs)*time.Millisecond)
+	select {
+	case <-wake:
+	default:
+	}
+}
+
+// processOrders streams claimed orders through the accrual system. Results
+// are stored in micro-batches of BatchSize orders or every BatchInterval,
+// while the pool is still running, and each stored order gets its next poll
+// scheduled. Orders without a result, e.g. after cancel, are released.
+func (a *HandlersAccrual) processOrders(ctx context.Context, orders []store.Order) int64 {
+	claimed := make(map[uint64]store.Order, len(orders))
+	for _, o := range orders {
+		claimed[o.OrderID] = o
+	}
+
+	results := a.s.StreamOrdersToAccrual(ctx, orders)
+
+	size := max(int(a.cfg.BatchSize), 1)
+	ticker := time.NewTicker(time.Duration(max(a.cfg.BatchIntervalMs, 1)) * time.Millisecond)
+	defer ticker.Stop()
+
+	var waitSec int
+	batch := make([]job.Result[httpclientpool.OrderResult], 0, size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		a.flushResults(claimed, batch)
+		for _, res := range batch {
+			delete(claimed, res.Value.Order.OrderID)
+		}
+		batch = batch[:0]
+	}
+
+	for open := true; open; {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				open = false
+				break
 			}
-			if err != nil {
-				a.l.Logger.Debug("Accrual: error send orders ", zap.Error(err))
-				continue
+			if len(results) == cap(results) {
+				a.stats.backPressure.Add(1)
 			}
-
-			a.l.Logger.Debug("Accrual: get resOrders", zap.Int("len ", len(resOrders)))
-			updOrders := make([]store.Order, 0)
-			for i := 0; i < len(orders); i++ {
-				if val, ok := resOrders[orders[i].OrderID]; ok {
-					if orders[i].Status != val.Status {
-						a.l.Logger.Debug("update", zap.String("oldstatus", orders[i].Status), zap.Any("new status", val))
-						updOrders = append(updOrders, val)
-					}
-				}
+			a.stats.results.Add(1)
+			if res.Value.Code == httpclientpool.HTTPRetryCode && res.Value.WaitSec > waitSec {
+				waitSec = res.Value.WaitSec
+			}
+			batch = append(batch, res)
+			if len(batch) >= size {
+				flush()
 			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+	flush()
 
-			a.l.Logger.Debug("Accrual: do update orders", zap.Int("len ", len(updOrders)))
+	if len(claimed) > 0 {
+		rest := make([]store.Order, 0, len(claimed))
+		for _, o := range claimed {
+			rest = append(rest, o)
+		}
+		a.releaseOrders(rest)
+	}
+	return int64(waitSec)
+}
 
-			if len(updOrders) == 0 {
-				continue
-			}
+// flushResults stores status changes of one micro-batch and schedules
+// the next poll of its orders. Responses failing validation are quarantined
+// and never reach balances, their orders are retried as failed ones.
+func (a *HandlersAccrual) flushResults(claimed map[uint64]store.Order, batch []job.Result[httpclientpool.OrderResult]) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReleaseTimeout)
+	defer cancel()
 
-			err = a.s.UpdateOrdersAndBalances(ctx, updOrders)
-			if err != nil {
-				a.l.Logger.Debug("Accrual: error update orders and balances ", zap.Error(err))
-			}
+	updOrders := make([]store.Order, 0, len(batch))
+	sched := make([]store.OrderSchedule, 0, len(batch))
+	var anomalies []store.Anomaly
+	for _, res := range batch {
+		o, ok := claimed[res.Value.Order.OrderID]
+		if !ok {
+			continue
 		}
+		if errors.Is(res.Err, httpclientpool.ErrAnomaly) {
+			a.l.Logger.Error("ALERT accrual anomaly quarantined", zap.Uint64("order", o.OrderID),
+				zap.String("provider", res.Value.Order.Provider), zap.ByteString("payload", res.Value.Raw), zap.Error(res.Err))
+			anomalies = append(anomalies, store.Anomaly{OrderID: o.OrderID, Provider: res.Value.Order.Provider,
+				Reason: res.Err.Error(), Payload: res.Value.Raw})
+		}
+		if res.Err == nil && res.Value.Code == httpclientpool.HTTPSuccessCode && res.Value.Order.Status != o.Status {
+			a.l.Logger.Debug("update", zap.String("oldstatus", o.Status), zap.Any("new status", res.Value.Order))
+			updOrders = append(updOrders, res.Value.Order)
+		}
+		sched = append(sched, a.nextSchedule(o, res, start))
+	}
+
+	if len(anomalies) > 0 {
+		a.stats.anomalies.Add(int64(len(anomalies)))
+		if err := a.s.QuarantineAccrual(ctx, anomalies); err != nil {
+			a.l.Logger.Error("Accrual: error quarantine anomalies ", zap.Error(err))
+		}
+	}
+	if len(updOrders) > 0 {
+		if err := a.s.UpdateOrdersAndBalances(ctx, updOrders); err != nil {
+			a.l.Logger.Debug("Accrual: error update orders and balances ", zap.Error(err))
+		}
+	}
+	if err := a.s.ScheduleOrders(ctx, sched); err != nil {
+		a.l.Logger.Debug("Accrual: error schedule orders ", zap.Error(err))
+	}
+
+	a.stats.batches.Add(1)
+	a.stats.lastFlushMs.Store(time.Since(start).Milliseconds())
+	a.l.Logger.Debug("Accrual: batch stored", zap.Int("results", len(batch)), zap.Int("updated", len(updOrders)),
+		zap.Duration("duration", time.Since(start)))
+}
+
+func (a *HandlersAccrual) releaseOrders(orders []store.Order) {
+	ctxRelease, cancel := context.WithTimeout(context.Background(), defaultReleaseTimeout)
+	defer cancel()
+	if err := a.s.ReleaseOrders(ctxRelease, orders); err != nil {
+		a.l.Logger.Debug("Accrual: error release orders ", zap.Error(err))
+	}
+}
+
+// nextSchedule releases the lease of the order and sets its next poll.
+// An order whose status moved is polled again soon, an unchanged one backs
+// off exponentially. Orders throttled by the accrual system or stopped by
+// the open circuit keep their attempt count and wait for Retry-After or the
+// circuit cooldown. Attempts only drive the backoff: an order is marked dead
+// with its last error after MaxAttempts failed polls in a row, any answer of
+// the accrual system resets the count.
+func (a *HandlersAccrual) nextSchedule(o store.Order, res job.Result[httpclientpool.OrderResult], now time.Time) store.OrderSchedule {
+	base := time.Duration(a.cfg.BackoffBaseSec) * time.Second
+	maxDelay := time.Duration(a.cfg.BackoffMaxSec) * time.Second
+	maxAge := time.Duration(a.cfg.MaxAgeSec) * time.Second
+
+	attempts := o.Attempts
+	var wait time.Duration
+	failed := res.Err != nil
+	ok := !failed && res.Value.Code == httpclientpool.HTTPSuccessCode
+	switch {
+	case failed && errors.Is(res.Err, httpclientpool.ErrCircuitOpen):
+		// not sent, the accrual system is unhealthy
+		failed = false
+		if _, retryAt := a.s.AccrualState(); retryAt.After(now) {
+			wait = retryAt.Sub(now)
+		}
+		attempts--
+	case !failed && res.Value.Code == httpclientpool.HTTPRetryCode:
+		wait = time.Duration(res.Value.WaitSec) * time.Second
+		attempts--
+	case ok && res.Value.Order.Status != o.Status:
+		attempts = 0
+	}
+	attempts = max(attempts, 0)
+
+	failures := o.Failures
+	switch {
+	case failed:
+		failures++
+	case ok:
+		failures = 0
+	}
+
+	delay := max(backoffDelay(attempts, base, maxDelay), wait)
+	sched := store.OrderSchedule{OrderID: o.OrderID, Attempts: attempts, Failures: failures,
+		NextAttempt: now.Add(delay), Provider: res.Value.Order.Provider}
+	if failed {
+		sched.LastError = res.Err.Error()
+		a.l.Logger.Debug("Accrual: order poll failed", zap.Uint64("order", o.OrderID),
+			zap.Int("failures", failures), zap.Error(res.Err))
+		if a.cfg.MaxAttempts > 0 && int64(failures) >= a.cfg.MaxAttempts {
+			sched.Dead = true
+			a.l.Logger.Warn("Accrual: order is dead", zap.Uint64("order", o.OrderID),
+				zap.Int("failures", failures), zap.Error(res.Err))
+			return sched
+		}
+	}
+
+	final := ok && (res.Value.Order.Status == "PROCESSED" || res.Value.Order.Status == "INVALID")
+	if !final && maxAge > 0 && now.Sub(o.TimeU) > maxAge {
+		sched.Stale = true
+		a.l.Logger.Warn("Accrual: order is stale", zap.Uint64("order", o.OrderID),
+			zap.Time("uploaded_at", o.TimeU), zap.Int("attempts", o.Attempts))
 	}
+	return sched
 }
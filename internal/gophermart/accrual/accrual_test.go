@@ -0,0 +1,313 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/httpclientpool"
+	"github.com/4aleksei/gmart/internal/common/httpclientpool/job"
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/notify"
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/4aleksei/gmart/internal/common/store/memory"
+	"github.com/4aleksei/gmart/internal/faccrual"
+	"github.com/4aleksei/gmart/internal/gophermart/config"
+	"github.com/4aleksei/gmart/internal/gophermart/service"
+	"github.com/greatcloak/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlersAccrual_processOrders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		switch number {
+		case "1":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"1","status":"PROCESSED","accrual":100}`))
+		case "2":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"2","status":"PROCESSING"}`))
+		case "3":
+			w.WriteHeader(http.StatusNoContent)
+		case "4":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"4","status":`))
+		case "6":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"1","status":"PROCESSED","accrual":100}`))
+		case "7":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"7","status":"PROCESSED","accrual":-100}`))
+		case "8":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order":"8","status":"INVALID","accrual":100}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		BatchSize:       2,
+		BatchIntervalMs: 10,
+		BackoffBaseSec:  2,
+		BackoffMaxSec:   600,
+		MaxAttempts:     2,
+	}
+	pool := httpclientpool.NewHandler(l)
+	pool.SetCfgInit(2, ts.URL)
+
+	stor := memory.New()
+	a := NewAccrual(cfg, service.NewService(stor, cfg, pool), l)
+
+	ctx := context.Background()
+	for i := uint64(1); i <= 8; i++ {
+		require.NoError(t, stor.InsertOrder(ctx, store.Order{OrderID: i, UserID: 1, Status: "NEW"}))
+	}
+	claimed, err := stor.ClaimOrdersForProcessing(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 8)
+
+	a.processOrders(ctx, claimed)
+
+	b, err := stor.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("100").Equal(b.Accrual))
+
+	o, err := stor.GetOneOrder(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSING", o.Status)
+	assert.Equal(t, 0, o.Attempts)
+	assert.True(t, o.LeasedUntil.IsZero())
+	assert.True(t, o.NextAttempt.After(time.Now()))
+
+	o, err = stor.GetOneOrder(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", o.Status)
+	assert.Contains(t, o.LastError, httpclientpool.ErrNotRegistered.Error())
+	assert.True(t, o.DeadAt.IsZero())
+
+	o, err = stor.GetOneOrder(ctx, 4)
+	require.NoError(t, err)
+	assert.Contains(t, o.LastError, httpclientpool.ErrJSONDecode.Error())
+
+	for _, id := range []uint64{6, 7, 8} {
+		o, err = stor.GetOneOrder(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "NEW", o.Status)
+		assert.Contains(t, o.LastError, httpclientpool.ErrAnomaly.Error())
+	}
+	anomalies, err := stor.GetAnomalies(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, anomalies, 3)
+	for _, an := range anomalies {
+		assert.NotEmpty(t, an.Payload)
+		assert.Equal(t, httpclientpool.DefaultProvider, an.Provider)
+	}
+
+	st := a.Stats()
+	assert.Equal(t, int64(8), st.Results)
+	assert.Equal(t, int64(3), st.Anomalies)
+	assert.GreaterOrEqual(t, st.Batches, int64(3))
+}
+
+func TestHandlersAccrual_wakeOnNewOrder(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order":"` + number + `","status":"PROCESSED","accrual":100}`))
+	}))
+	defer ts.Close()
+
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		PollInterval:     60,
+		ClaimLimit:       10,
+		LeaseSec:         60,
+		BatchSize:        10,
+		BatchIntervalMs:  10,
+		NotifyDebounceMs: 200,
+	}
+	pool := httpclientpool.NewHandler(l)
+	pool.SetCfgInit(2, ts.URL)
+
+	stor := memory.New()
+	s := service.NewService(stor, cfg, pool)
+	s.SetNotifier(notify.NewLocal())
+	a := NewAccrual(cfg, s, l)
+
+	ctx := context.Background()
+	require.NoError(t, a.Start(ctx))
+	defer func() { require.NoError(t, a.Stop(ctx)) }()
+
+	require.NoError(t, s.RegisterOrder(ctx, "1", "79927398713"))
+	require.NoError(t, s.RegisterOrder(ctx, "1", "5062821234567892"))
+
+	assert.Eventually(t, func() bool {
+		b, err := stor.GetBalance(ctx, 1)
+		return err == nil && decimal.RequireFromString("200").Equal(b.Accrual)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), a.Stats().Wakeups)
+}
+
+func TestHandlersAccrual_faccrual(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	fa := faccrual.New(faccrual.Config{Processing: 100 * time.Millisecond}, l)
+	require.NoError(t, fa.AddReward(faccrual.Reward{Match: "Bork", Reward: decimal.RequireFromString("10"), RewardType: faccrual.RewardPercent}))
+	require.NoError(t, fa.AddOrder(faccrual.OrderRequest{Order: "79927398713",
+		Goods: []faccrual.Good{{Description: "Чайник Bork", Price: decimal.RequireFromString("7000")}}}))
+	require.NoError(t, fa.AddOrder(faccrual.OrderRequest{Order: "5062821234567892",
+		Goods: []faccrual.Good{{Description: "Cup", Price: decimal.RequireFromString("50")}}}))
+	ts := httptest.NewServer(fa.Handler())
+	defer ts.Close()
+
+	cfg := &config.Config{BatchSize: 10, BatchIntervalMs: 10, MaxAttempts: 5}
+	pool := httpclientpool.NewHandler(l)
+	pool.SetCfgInit(2, ts.URL)
+	stor := memory.New()
+	a := NewAccrual(cfg, service.NewService(stor, cfg, pool), l)
+
+	ctx := context.Background()
+	for _, id := range []uint64{79927398713, 5062821234567892, 2377225624} {
+		require.NoError(t, stor.InsertOrder(ctx, store.Order{OrderID: id, UserID: 1, Status: "NEW"}))
+	}
+	poll := func() {
+		claimed, err := stor.ClaimOrdersForProcessing(ctx, 10, time.Minute)
+		require.NoError(t, err)
+		a.processOrders(ctx, claimed)
+	}
+
+	poll()
+	o, err := stor.GetOneOrder(ctx, 79927398713)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSING", o.Status)
+
+	time.Sleep(150 * time.Millisecond)
+	poll()
+	o, err = stor.GetOneOrder(ctx, 79927398713)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", o.Status)
+	o, err = stor.GetOneOrder(ctx, 5062821234567892)
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", o.Status)
+	o, err = stor.GetOneOrder(ctx, 2377225624)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", o.Status)
+	assert.Contains(t, o.LastError, httpclientpool.ErrNotRegistered.Error())
+
+	b, err := stor.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("700").Equal(b.Accrual))
+}
+
+func TestHandlersAccrual_faccrualChaos(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	fa := faccrual.New(faccrual.Config{}, l)
+	require.NoError(t, fa.AddReward(faccrual.Reward{Match: "Bork", Reward: decimal.RequireFromString("100"), RewardType: faccrual.RewardPoints}))
+	require.NoError(t, fa.AddOrder(faccrual.OrderRequest{Order: "79927398713",
+		Goods: []faccrual.Good{{Description: "Bork"}}}))
+	ts := httptest.NewServer(fa.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		chaos   faccrual.Chaos
+		err     error
+		waitSec int64
+	}{
+		{name: "429", chaos: faccrual.Chaos{TooManyRequests: 1, RetryAfter: 3}, waitSec: 3},
+		{name: "500", chaos: faccrual.Chaos{ServerError: 1}, err: httpclientpool.ErrServerError},
+		{name: "204", chaos: faccrual.Chaos{NoContent: 1}, err: httpclientpool.ErrNotRegistered},
+		{name: "malformed", chaos: faccrual.Chaos{Malformed: 1}, err: httpclientpool.ErrJSONDecode},
+		{name: "truncated", chaos: faccrual.Chaos{Truncated: 1}, err: httpclientpool.ErrJSONDecode},
+		{name: "drop", chaos: faccrual.Chaos{Drop: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, fa.SetChaos(tt.chaos))
+
+			cfg := &config.Config{BatchSize: 10, BatchIntervalMs: 10, BackoffBaseSec: 2, BackoffMaxSec: 600, MaxAttempts: 5}
+			pool := httpclientpool.NewHandler(l)
+			pool.SetCfgInit(1, ts.URL)
+			stor := memory.New()
+			a := NewAccrual(cfg, service.NewService(stor, cfg, pool), l)
+
+			ctx := context.Background()
+			require.NoError(t, stor.InsertOrder(ctx, store.Order{OrderID: 79927398713, UserID: 1, Status: "NEW"}))
+			claimed, err := stor.ClaimOrdersForProcessing(ctx, 10, time.Minute)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.waitSec, a.processOrders(ctx, claimed))
+
+			o, err := stor.GetOneOrder(ctx, 79927398713)
+			require.NoError(t, err)
+			assert.Equal(t, "NEW", o.Status)
+			assert.True(t, o.LeasedUntil.IsZero())
+			switch {
+			case tt.err != nil:
+				assert.Contains(t, o.LastError, tt.err.Error())
+			case tt.waitSec > 0:
+				assert.Empty(t, o.LastError)
+				assert.Equal(t, 0, o.Attempts)
+			default:
+				assert.NotEmpty(t, o.LastError)
+			}
+			_, err = stor.GetBalance(ctx, 1)
+			assert.ErrorIs(t, err, store.ErrRowNotFound)
+		})
+	}
+}
+
+func TestHandlersAccrual_nextScheduleDead(t *testing.T) {
+	l, err := logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		BackoffBaseSec: 2,
+		BackoffMaxSec:  600,
+		MaxAttempts:    3,
+	}
+	a := NewAccrual(cfg, service.NewService(memory.New(), cfg, nil), l)
+
+	o := store.Order{OrderID: 1, UserID: 1, Status: "PROCESSING", TimeU: time.Now()}
+	unchanged := job.Result[httpclientpool.OrderResult]{Value: httpclientpool.OrderResult{
+		Order: store.Order{OrderID: 1, Status: "PROCESSING"}, Code: httpclientpool.HTTPSuccessCode}}
+	failed := job.Result[httpclientpool.OrderResult]{Err: httpclientpool.ErrNotRegistered}
+	poll := func(res job.Result[httpclientpool.OrderResult]) store.OrderSchedule {
+		o.Attempts++
+		sched := a.nextSchedule(o, res, time.Now())
+		o.Attempts, o.Failures = sched.Attempts, sched.Failures
+		return sched
+	}
+
+	for i := 0; i < 10; i++ {
+		poll(unchanged)
+	}
+	sched := poll(failed)
+	assert.False(t, sched.Dead)
+	assert.Equal(t, 11, sched.Attempts)
+	assert.Equal(t, 1, sched.Failures)
+
+	sched = poll(unchanged)
+	assert.Equal(t, 0, sched.Failures)
+
+	poll(failed)
+	poll(failed)
+	sched = poll(failed)
+	assert.True(t, sched.Dead)
+	assert.Equal(t, 3, sched.Failures)
+}
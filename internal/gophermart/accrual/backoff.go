@@ -0,0 +1,30 @@
+package accrual
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const maxBackoffShift = 30
+
+// backoffDelay returns the exponential delay for the given number of
+// unsuccessful attempts, capped by max, with half of it randomized so
+// orders uploaded together do not come back together.
+func backoffDelay(attempts int, base, max time.Duration) time.Duration {
+	shift := attempts - 1
+	if shift < 0 {
+		shift = 0
+	}
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	d := base << shift
+	if d <= 0 || d > max {
+		d = max
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(d-half+1)
+}
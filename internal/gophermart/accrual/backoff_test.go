@@ -0,0 +1,33 @@
+package accrual
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_backoffDelay(t *testing.T) {
+	base, max := 2*time.Second, time.Minute
+	tests := []struct {
+		name     string
+		attempts int
+		low      time.Duration
+		high     time.Duration
+	}{
+		{name: "fresh order", attempts: 0, low: time.Second, high: 2 * time.Second},
+		{name: "first attempt", attempts: 1, low: time.Second, high: 2 * time.Second},
+		{name: "third attempt", attempts: 3, low: 4 * time.Second, high: 8 * time.Second},
+		{name: "capped", attempts: 10, low: 30 * time.Second, high: time.Minute},
+		{name: "overflow", attempts: 1000, low: 30 * time.Second, high: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := backoffDelay(tt.attempts, base, max)
+				assert.GreaterOrEqual(t, d, tt.low)
+				assert.LessOrEqual(t, d, tt.high)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package app
 
 import (
+	"expvar"
 	"time"
 
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/4aleksei/gmart/internal/common/store"
 
 	"github.com/4aleksei/gmart/internal/common/httpclientpool"
+	"github.com/4aleksei/gmart/internal/common/notify"
+	"github.com/4aleksei/gmart/internal/common/store/memory"
 	"github.com/4aleksei/gmart/internal/common/store/pg"
 	"github.com/4aleksei/gmart/internal/common/utils"
 	"github.com/4aleksei/gmart/internal/gophermart/accrual"
@@ -26,7 +29,7 @@ func SetupFX() *fx.App {
 		fx.Provide(
 			logger.New,
 			config.GetConfig,
-			fx.Annotate(pg.New,
+			fx.Annotate(newStore,
 				fx.As(new(service.ServiceStore)), fx.As(new(store.Store))),
 			httpclientpool.NewHandler,
 			service.NewService,
@@ -40,22 +43,56 @@ func SetupFX() *fx.App {
 			registerSetLoggerLevel,
 			gooseUP,
 			registerStorePg,
+			registerNotifier,
+			registerDevAccrual,
 			registerHTTPClientPool,
 			registerAccrualClient,
+			registerIdempotencyPurger,
 			registerHTTPServer,
 		),
 	)
 	return app
 }
 
+func newStore(cfg *config.Config, ll *logger.ZapLogger) store.Store {
+	if cfg.DatabaseURI == "" {
+		ll.Logger.Info("database URI is empty, using in-memory store")
+		return memory.New()
+	}
+	return pg.New(ll)
+}
+
 func gooseUP(cfg *config.Config, ll *logger.ZapLogger) {
+	if cfg.DatabaseURI == "" {
+		return
+	}
+	if !cfg.Migrate {
+		ll.Logger.Info("migrations disabled, skip")
+		return
+	}
 	if err := migrate(cfg.DatabaseURI, ll); err != nil {
 		ll.Logger.Fatal("migrate fatal", zap.Error(err))
 	}
 }
 
-func registerHTTPClientPool(h *httpclientpool.PoolHandler, cfg *config.Config) {
+func registerHTTPClientPool(h *httpclientpool.PoolHandler, cfg *config.Config, lc fx.Lifecycle) error {
 	h.SetCfgInit(uint64(cfg.RateLimit), cfg.AccrualSystemAddress)
+	h.SetRequestRate(cfg.RequestRate)
+	h.SetBreaker(int(cfg.BreakerFailures), time.Duration(cfg.BreakerCooldownSec)*time.Second, 1)
+	if cfg.ProvidersFile != "" {
+		rc, err := httpclientpool.LoadRouting(cfg.ProvidersFile)
+		if err != nil {
+			return err
+		}
+		if err := h.SetRouting(rc); err != nil {
+			return err
+		}
+	}
+	expvar.Publish("accrual_limiter", expvar.Func(func() any { return h.LimiterStats() }))
+	expvar.Publish("accrual_breaker", expvar.Func(func() any { return h.BreakerStats() }))
+	expvar.Publish("accrual_endpoints", expvar.Func(func() any { return h.EndpointStats() }))
+	lc.Append(utils.ToHook(h))
+	return nil
 }
 
 func registerStorePg(ss store.Store, cfg *config.Config, lc fx.Lifecycle) {
@@ -67,7 +104,26 @@ func registerStorePg(ss store.Store, cfg *config.Config, lc fx.Lifecycle) {
 	}
 }
 
+// registerNotifier lets registered orders wake the accrual poller, with pg
+// also when API and poller run in separate processes.
+func registerNotifier(s *service.HandleService, ss store.Store, cfg *config.Config, ll *logger.ZapLogger, lc fx.Lifecycle) {
+	switch cfg.Notify {
+	case config.NotifyOff:
+		return
+	case config.NotifyPg:
+		if v, ok := ss.(*pg.PgStore); ok {
+			n := pg.NewNotifier(v, pg.DefaultNotifyChannel)
+			s.SetNotifier(n)
+			lc.Append(utils.ToHook(n))
+			return
+		}
+		ll.Logger.Info("pg notifier needs a database, using local notifier")
+	}
+	s.SetNotifier(notify.NewLocal())
+}
+
 func registerAccrualClient(hh *accrual.HandlersAccrual, lc fx.Lifecycle) {
+	expvar.Publish("accrual_pipeline", expvar.Func(func() any { return hh.Stats() }))
 	lc.Append(utils.ToHook(hh))
 }
 
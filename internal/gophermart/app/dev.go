@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/models"
+	"github.com/4aleksei/gmart/internal/common/utils"
+	"github.com/4aleksei/gmart/internal/faccrual"
+	"github.com/4aleksei/gmart/internal/gophermart/config"
+	"github.com/4aleksei/gmart/internal/gophermart/service"
+	"github.com/greatcloak/decimal"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	devRegistered = 3 * time.Second
+	devProcessing = 5 * time.Second
+)
+
+type (
+	// devAccrual serves the accrual simulator in the process in dev mode.
+	devAccrual struct {
+		fa  *faccrual.Server
+		srv *http.Server
+		ln  net.Listener
+		s   *service.HandleService
+		l   *logger.ZapLogger
+	}
+
+	devUser struct {
+		name, password string
+		orders         []faccrual.OrderRequest
+	}
+)
+
+// devUsers are the demo users with orders known to the simulator: rewarded
+// ones end PROCESSED, the rest INVALID.
+var devUsers = []devUser{
+	{name: "demo", password: "demo", orders: []faccrual.OrderRequest{
+		{Order: "79927398713", Goods: []faccrual.Good{{Description: "Чайник Bork", Price: decimal.NewFromInt(7000)}}},
+		{Order: "5062821234567892", Goods: []faccrual.Good{{Description: "Acme mug", Price: decimal.NewFromInt(300)}}},
+		{Order: "2377225624", Goods: []faccrual.Good{{Description: "Paper bag", Price: decimal.NewFromInt(5)}}},
+	}},
+	{name: "alice", password: "alice", orders: []faccrual.OrderRequest{
+		{Order: "4561261212345467", Goods: []faccrual.Good{{Description: "Bork toaster", Price: decimal.NewFromInt(4500)}}},
+	}},
+}
+
+var devRewards = []faccrual.Reward{
+	{Match: "Bork", Reward: decimal.NewFromInt(10), RewardType: faccrual.RewardPercent},
+	{Match: "Acme", Reward: decimal.NewFromInt(50), RewardType: faccrual.RewardPoints},
+}
+
+// registerDevAccrual starts the accrual simulator on a loopback port and
+// points the accrual client to it. It has to run before the client pool is
+// set up.
+func registerDevAccrual(cfg *config.Config, s *service.HandleService, ll *logger.ZapLogger, lc fx.Lifecycle) error {
+	if !cfg.Dev {
+		return nil
+	}
+	fcfg := faccrual.DefaultConfig()
+	fcfg.Registered = devRegistered
+	fcfg.Processing = devProcessing
+	fa := faccrual.New(fcfg, ll)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	cfg.AccrualSystemAddress = "http://" + ln.Addr().String()
+	cfg.ProvidersFile = ""
+
+	d := &devAccrual{
+		fa:  fa,
+		srv: &http.Server{Handler: fa.Handler(), ReadHeaderTimeout: 2 * time.Second},
+		ln:  ln,
+		s:   s,
+		l:   ll,
+	}
+	lc.Append(utils.ToHook(d))
+	return nil
+}
+
+func (d *devAccrual) Start(ctx context.Context) error {
+	go func() {
+		if err := d.srv.Serve(d.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.l.Logger.Error("dev accrual simulator", zap.Error(err))
+		}
+	}()
+	d.l.Logger.Info("dev mode: accrual simulator started", zap.String("address", d.ln.Addr().String()))
+	return seedDemo(ctx, d.s, d.fa, d.l)
+}
+
+func (d *devAccrual) Stop(ctx context.Context) error {
+	return d.srv.Shutdown(ctx)
+}
+
+// seedDemo registers the demo users and their orders in gophermart and in
+// the simulator.
+func seedDemo(ctx context.Context, s *service.HandleService, fa *faccrual.Server, ll *logger.ZapLogger) error {
+	for _, r := range devRewards {
+		if err := fa.AddReward(r); err != nil {
+			return err
+		}
+	}
+	for _, u := range devUsers {
+		userID, err := s.RegisterUser(ctx, models.UserRegistration{Name: u.name, Password: u.password})
+		if err != nil {
+			return err
+		}
+		for _, o := range u.orders {
+			if err := fa.AddOrder(o); err != nil {
+				return err
+			}
+			if err := s.RegisterOrder(ctx, userID, o.Order); err != nil {
+				return err
+			}
+		}
+		ll.Logger.Info("dev mode: demo user", zap.String("login", u.name), zap.String("password", u.password),
+			zap.Int("orders", len(u.orders)))
+	}
+	return nil
+}
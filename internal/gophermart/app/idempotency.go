@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/utils"
+	"github.com/4aleksei/gmart/internal/gophermart/config"
+	"github.com/4aleksei/gmart/internal/gophermart/service"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const idempotencyPurgeEvery = 10 * time.Minute
+
+// idempotencyPurger removes expired idempotency keys and their stored
+// responses every idempotencyPurgeEvery.
+type idempotencyPurger struct {
+	s      *service.HandleService
+	ttl    time.Duration
+	l      *logger.ZapLogger
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+func registerIdempotencyPurger(cfg *config.Config, s *service.HandleService, ll *logger.ZapLogger, lc fx.Lifecycle) {
+	if cfg.IdempotencyTTLSec <= 0 {
+		return
+	}
+	p := &idempotencyPurger{s: s, ttl: time.Duration(cfg.IdempotencyTTLSec) * time.Second, l: ll}
+	lc.Append(utils.ToHook(p))
+}
+
+func (p *idempotencyPurger) Start(ctx context.Context) error {
+	ctxCancel, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.wg.Add(1)
+	go p.run(ctxCancel)
+	return nil
+}
+
+func (p *idempotencyPurger) Stop(ctx context.Context) error {
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *idempotencyPurger) run(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(idempotencyPurgeEvery)
+	defer ticker.Stop()
+	for {
+		p.purge(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *idempotencyPurger) purge(ctx context.Context) {
+	n, err := p.s.PurgeIdempotencyKeys(ctx, p.ttl)
+	if err != nil {
+		p.l.Logger.Error("error purging idempotency keys", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		p.l.Logger.Debug("purged idempotency keys", zap.Int("count", n))
+	}
+}
@@ -1,9 +1,12 @@
 package app
 
 import (
+	"database/sql"
 	"embed"
-
+	"errors"
+	"flag"
 	"fmt"
+	"os"
 
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/pressly/goose/v3"
@@ -13,6 +16,20 @@ import (
 //go:embed migrations/*.sql
 var embedMigrations embed.FS
 
+const migrationsDir = "migrations"
+
+const (
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+	MigrateStatus = "status"
+	MigrateRedo   = "redo"
+)
+
+var (
+	ErrMigrateCommand = errors.New("usage: gophermart migrate [-d uri] up|down|status|redo")
+	ErrMigrateNoDB    = errors.New("database URI is empty")
+)
+
 type gooseLogger struct {
 	l *zap.Logger
 }
@@ -24,12 +41,21 @@ func (l *gooseLogger) Printf(format string, v ...interface{}) {
 	l.l.Info("goose info", zap.String("msg", fmt.Sprintf(format, v...)))
 }
 
-func migrate(dbURI string, ll *logger.ZapLogger) error {
+func openMigrations(dbURI string, ll *logger.ZapLogger) (*sql.DB, error) {
 	var g = gooseLogger{l: ll.Logger}
 
 	goose.SetLogger(&g)
+	goose.SetBaseFS(embedMigrations)
+
+	if err := goose.SetDialect("postgres"); err != nil {
+		return nil, err
+	}
+
+	return goose.OpenDBWithDriver("postgres", dbURI)
+}
 
-	db, err := goose.OpenDBWithDriver("postgres", dbURI)
+func runMigrations(dbURI, command string, ll *logger.ZapLogger) error {
+	db, err := openMigrations(dbURI, ll)
 	if err != nil {
 		return err
 	}
@@ -38,18 +64,49 @@ func migrate(dbURI string, ll *logger.ZapLogger) error {
 		db.Close()
 	}()
 
-	goose.SetBaseFS(embedMigrations)
+	switch command {
+	case MigrateUp:
+		return goose.Up(db, migrationsDir)
+	case MigrateDown:
+		return goose.Down(db, migrationsDir)
+	case MigrateStatus:
+		return goose.Status(db, migrationsDir)
+	case MigrateRedo:
+		return goose.Redo(db, migrationsDir)
+	default:
+		return ErrMigrateCommand
+	}
+}
 
-	if err := goose.SetDialect("postgres"); err != nil {
+func migrate(dbURI string, ll *logger.ZapLogger) error {
+	return runMigrations(dbURI, MigrateUp, ll)
+}
+
+// RunMigrate implements the "gophermart migrate" subcommand.
+func RunMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dbURI := fs.String("d", "", "database postgres URI")
+	level := fs.String("v", "info", "level of logging")
+	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
-	if err := goose.DownTo(db, "migrations", 0); err != nil {
-		return err
+	if *dbURI == "" {
+		*dbURI = os.Getenv("DATABASE_URI")
+	}
+	if *dbURI == "" {
+		return ErrMigrateNoDB
+	}
+
+	if fs.NArg() != 1 {
+		return ErrMigrateCommand
 	}
 
-	if err := goose.Up(db, "migrations"); err != nil {
+	ll, err := logger.New(logger.Config{Level: *level})
+	if err != nil {
 		return err
 	}
-	return nil
+	defer func() { _ = ll.Logger.Sync() }()
+
+	return runMigrations(*dbURI, fs.Arg(0), ll)
 }
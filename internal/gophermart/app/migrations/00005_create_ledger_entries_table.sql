@@ -0,0 +1,60 @@
+-- +goose Up
+
+CREATE TYPE  ledger_entry_type AS ENUM (
+'CREDIT',
+'DEBIT'
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    entry_id BIGSERIAL PRIMARY KEY,
+    user_id bigint not null,
+    entry_type ledger_entry_type not null,
+    amount decimal(19,2) not null CHECK (amount >= 0),
+    order_id bigint REFERENCES orders (order_id),
+    withdrawal_id bigint REFERENCES withdrawals (order_id),
+    created_at timestamptz not null DEFAULT NOW(),
+    CHECK ((entry_type = 'CREDIT' AND order_id IS NOT NULL AND withdrawal_id IS NULL)
+        OR (entry_type = 'DEBIT' AND withdrawal_id IS NOT NULL AND order_id IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entries_order_id_idx ON ledger_entries (order_id);
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_entries_withdrawal_id_idx ON ledger_entries (withdrawal_id);
+CREATE INDEX IF NOT EXISTS ledger_entries_user_id_idx ON ledger_entries (user_id, created_at);
+
+INSERT INTO ledger_entries (user_id, entry_type, amount, order_id, created_at)
+    SELECT user_id, 'CREDIT', accrual, order_id, changed_at FROM orders
+        WHERE status = 'PROCESSED' AND accrual > 0;
+
+INSERT INTO ledger_entries (user_id, entry_type, amount, withdrawal_id, created_at)
+    SELECT user_id, 'DEBIT', sum, order_id, processed_at FROM withdrawals
+        WHERE user_id IS NOT NULL;
+
+-- balances follow the ledger: the old batch credited again on every update
+UPDATE balances SET current = 0, withdrawn = 0, changed_at = now()
+    WHERE user_id NOT IN (SELECT user_id FROM ledger_entries);
+
+INSERT INTO balances (user_id, current, withdrawn, changed_at)
+    SELECT user_id,
+        SUM(CASE WHEN entry_type = 'CREDIT' THEN amount ELSE -amount END),
+        SUM(CASE WHEN entry_type = 'DEBIT' THEN amount ELSE 0 END),
+        now()
+    FROM ledger_entries GROUP BY user_id
+    ON CONFLICT (user_id) DO UPDATE SET current = excluded.current, withdrawn = excluded.withdrawn,
+        changed_at = excluded.changed_at;
+
+-- +goose StatementBegin
+CREATE FUNCTION ledger_entries_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER ledger_entries_no_change BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_entries_immutable();
+
+
+-- +goose Down
+DROP TABLE ledger_entries;
+DROP FUNCTION ledger_entries_immutable;
+DROP TYPE ledger_entry_type;
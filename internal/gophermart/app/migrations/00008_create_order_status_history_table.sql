@@ -0,0 +1,21 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+    history_id BIGSERIAL PRIMARY KEY,
+    order_id bigint not null REFERENCES orders (order_id),
+    status order_status_type not null,
+    accrual decimal(19,2),
+    changed_at timestamptz not null DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_id_idx ON order_status_history (order_id, changed_at);
+
+INSERT INTO order_status_history (order_id, status, accrual, changed_at)
+    SELECT order_id, 'NEW', 0, uploaded_at FROM orders;
+
+INSERT INTO order_status_history (order_id, status, accrual, changed_at)
+    SELECT order_id, status, accrual, changed_at FROM orders WHERE status <> 'NEW';
+
+
+-- +goose Down
+DROP TABLE order_status_history;
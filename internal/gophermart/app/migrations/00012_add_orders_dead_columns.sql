@@ -0,0 +1,18 @@
+-- +goose Up
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS dead_at timestamptz;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS last_error text;
+
+DROP INDEX IF EXISTS orders_processing_idx;
+CREATE INDEX IF NOT EXISTS orders_processing_idx ON orders (next_attempt_at)
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND stale_at IS NULL AND dead_at IS NULL;
+CREATE INDEX IF NOT EXISTS orders_dead_idx ON orders (dead_at) WHERE dead_at IS NOT NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS orders_dead_idx;
+DROP INDEX IF EXISTS orders_processing_idx;
+CREATE INDEX IF NOT EXISTS orders_processing_idx ON orders (next_attempt_at)
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND stale_at IS NULL;
+ALTER TABLE orders DROP COLUMN last_error;
+ALTER TABLE orders DROP COLUMN dead_at;
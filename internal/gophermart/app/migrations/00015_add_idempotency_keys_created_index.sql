@@ -0,0 +1,7 @@
+-- +goose Up
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idempotency_keys_created_idx;
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/4aleksei/gmart/internal/common/logger"
+	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/4aleksei/gmart/internal/common/store/pg"
+)
+
+const (
+	OrdersDead      = "dead"
+	OrdersRequeue   = "requeue"
+	OrdersAnomalies = "anomalies"
+
+	defaultDeadLimit = 100
+)
+
+var (
+	ErrOrdersCommand = errors.New("usage: gophermart orders [-d uri] [-n limit] dead | anomalies | requeue order...")
+)
+
+// RunOrders implements the "gophermart orders" subcommand: it lists orders
+// that are not polled anymore and puts them back to polling, and lists
+// quarantined accrual responses.
+func RunOrders(args []string) error {
+	fs := flag.NewFlagSet("orders", flag.ContinueOnError)
+	dbURI := fs.String("d", "", "database postgres URI")
+	level := fs.String("v", "info", "level of logging")
+	limit := fs.Int("n", defaultDeadLimit, "max orders listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *dbURI == "" {
+		*dbURI = os.Getenv("DATABASE_URI")
+	}
+	if *dbURI == "" {
+		return ErrMigrateNoDB
+	}
+	if fs.NArg() < 1 {
+		return ErrOrdersCommand
+	}
+
+	ids := make([]uint64, 0, fs.NArg()-1)
+	for _, v := range fs.Args()[1:] {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad order %s: %w", v, err)
+		}
+		ids = append(ids, id)
+	}
+
+	ll, err := logger.New(logger.Config{Level: *level})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ll.Logger.Sync() }()
+
+	s := pg.New(ll)
+	s.DatabaseURI = *dbURI
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	defer s.Close(ctx)
+
+	switch fs.Arg(0) {
+	case OrdersDead:
+		orders, err := s.GetDeadOrders(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		return printDeadOrders(os.Stdout, orders)
+	case OrdersAnomalies:
+		anomalies, err := s.GetAnomalies(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		return printAnomalies(os.Stdout, anomalies)
+	case OrdersRequeue:
+		if len(ids) == 0 {
+			return ErrOrdersCommand
+		}
+		n, err := s.RequeueOrders(ctx, ids)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("requeued %d of %d orders\n", n, len(ids))
+		return nil
+	default:
+		return ErrOrdersCommand
+	}
+}
+
+func printDeadOrders(w io.Writer, orders []store.Order) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER\tUSER\tSTATUS\tSTATE\tSINCE\tATTEMPTS\tFAILURES\tLAST ERROR")
+	for _, o := range orders {
+		state, since := "dead", o.DeadAt
+		if o.DeadAt.IsZero() {
+			state, since = "stale", o.StaleAt
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%d\t%d\t%s\n", o.OrderID, o.UserID, o.Status, state,
+			since.Format(time.RFC3339), o.Attempts, o.Failures, o.LastError)
+	}
+	return tw.Flush()
+}
+
+func printAnomalies(w io.Writer, anomalies []store.Anomaly) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER\tPROVIDER\tAT\tREASON\tPAYLOAD")
+	for _, a := range anomalies {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%q\n", a.OrderID, a.Provider,
+			a.TimeC.Format(time.RFC3339), a.Reason, a.Payload)
+	}
+	return tw.Flush()
+}
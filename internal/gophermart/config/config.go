@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"os"
+	"strconv"
 
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/4aleksei/gmart/internal/common/utils"
@@ -13,38 +14,97 @@ type Config struct {
 	Address              string
 	DatabaseURI          string
 	AccrualSystemAddress string
+	ProvidersFile        string
+	Notify               string
 	Key                  string
 	KeySignature         string
+	CallbackSecret       string
 	LCfg                 logger.Config
 	PollInterval         int64
 	RateLimit            int64
+	RequestRate          float64
+	ClaimLimit           int64
+	BatchSize            int64
+	BatchIntervalMs      int64
+	NotifyDebounceMs     int64
+	LeaseSec             int64
+	BackoffBaseSec       int64
+	BackoffMaxSec        int64
+	MaxAgeSec            int64
+	MaxAttempts          int64
+	BreakerFailures      int64
+	BreakerCooldownSec   int64
+	IdempotencyTTLSec    int64
+	Migrate              bool
+	Dev                  bool
 }
 
 const (
-	addressDefault      string = ":8090"
-	levelDefault        string = "debug"
-	databaseURIDefault  string = ""
-	accrualSAddDef      string = "localhost:8100"
-	keyDefault          string = ""
-	keySignatureDefault string = ""
-	pollIntervalDefault int64  = 2
-	rateLimitDefault    int64  = 2
+	addressDefault      string  = ":8090"
+	levelDefault        string  = "debug"
+	databaseURIDefault  string  = ""
+	accrualSAddDef      string  = "localhost:8100"
+	providersFileDef    string  = ""
+	notifyDefault       string  = NotifyLocal
+	keyDefault          string  = ""
+	keySignatureDefault string  = ""
+	callbackSecDefault  string  = ""
+	pollIntervalDefault int64   = 2
+	rateLimitDefault    int64   = 2
+	requestRateDefault  float64 = 0
+	claimLimitDefault   int64   = 100
+	batchSizeDefault    int64   = 20
+	batchIntervalDef    int64   = 500
+	notifyDebounceDef   int64   = 100
+	leaseSecDefault     int64   = 60
+	backoffBaseDefault  int64   = 2
+	backoffMaxDefault   int64   = 600
+	maxAgeDefault       int64   = 7 * 24 * 3600
+	maxAttemptsDefault  int64   = 20
+	breakerFailDefault  int64   = 5
+	breakerCoolDefault  int64   = 30
+	idempotencyTTLDef   int64   = 24 * 3600
+	migrateDefault      bool    = true
 
 	defaultKeyLen int = 16
 )
 
+const (
+	NotifyLocal = "local"
+	NotifyPg    = "pg"
+	NotifyOff   = "off"
+)
+
 func GetConfig() *Config {
 	cfg := new(Config)
 
 	flag.StringVar(&cfg.Address, "a", addressDefault, "address and port to run server gopthermart")
 	flag.StringVar(&cfg.LCfg.Level, "v", levelDefault, "level of logging")
-	flag.StringVar(&cfg.AccrualSystemAddress, "r", accrualSAddDef, "accrual client`s address and port")
+	flag.StringVar(&cfg.AccrualSystemAddress, "r", accrualSAddDef, "accrual client`s address and port, comma separated for several endpoints")
 
+	flag.StringVar(&cfg.ProvidersFile, "providers", providersFileDef, "JSON file with accrual providers and routing rules")
 	flag.StringVar(&cfg.DatabaseURI, "d", databaseURIDefault, "database postgres URI")
 	flag.Int64Var(&cfg.PollInterval, "i", pollIntervalDefault, "interval bd  request for accrual")
 	flag.Int64Var(&cfg.RateLimit, "l", rateLimitDefault, "workers count")
+	flag.Float64Var(&cfg.RequestRate, "rps", requestRateDefault, "max requests per second to accrual, 0 - no limit")
 	flag.StringVar(&cfg.Key, "k", keyDefault, "key for jwt signature")
 	flag.StringVar(&cfg.KeySignature, "s", keySignatureDefault, "key for signature")
+	flag.StringVar(&cfg.CallbackSecret, "callback-secret", callbackSecDefault, "shared secret of accrual callbacks, empty - callbacks disabled")
+	flag.Int64Var(&cfg.ClaimLimit, "claim", claimLimitDefault, "max orders claimed by one accrual poll")
+	flag.Int64Var(&cfg.BatchSize, "batch", batchSizeDefault, "accrual results stored in one batch")
+	flag.Int64Var(&cfg.BatchIntervalMs, "batch-interval", batchIntervalDef, "milliseconds before a partial batch of accrual results is stored")
+	flag.StringVar(&cfg.Notify, "notify", notifyDefault, "wake the accrual poller on new orders: local, pg - across processes with LISTEN/NOTIFY, off")
+	flag.Int64Var(&cfg.NotifyDebounceMs, "notify-debounce", notifyDebounceDef, "milliseconds new order signals are merged into one poll")
+	flag.Int64Var(&cfg.LeaseSec, "lease", leaseSecDefault, "seconds an accrual poller holds claimed orders")
+	flag.Int64Var(&cfg.BackoffBaseSec, "backoff-base", backoffBaseDefault, "seconds before the first repeated poll of an order")
+	flag.Int64Var(&cfg.BackoffMaxSec, "backoff-max", backoffMaxDefault, "max seconds between polls of an order")
+	flag.Int64Var(&cfg.MaxAgeSec, "max-age", maxAgeDefault, "seconds after upload when a pending order is marked stale, 0 - never")
+	flag.Int64Var(&cfg.MaxAttempts, "max-attempts", maxAttemptsDefault, "failed polls in a row after which an order is dead, 0 - never")
+	flag.Int64Var(&cfg.BreakerFailures, "breaker-failures", breakerFailDefault, "accrual failures in a row that open the circuit")
+	flag.Int64Var(&cfg.BreakerCooldownSec, "breaker-cooldown", breakerCoolDefault, "seconds the accrual circuit stays open")
+	flag.Int64Var(&cfg.IdempotencyTTLSec, "idempotency-ttl", idempotencyTTLDef, "seconds idempotency keys and their responses are kept, 0 - forever")
+	flag.BoolVar(&cfg.Migrate, "migrate", migrateDefault, "apply pending migrations on startup")
+	flag.BoolVar(&cfg.Dev, "dev", false, "dev mode: in-memory store, in-process accrual simulator and demo data")
 	flag.Parse()
 
 	if envKey := os.Getenv("KEY"); cfg.Key == keyDefault && envKey != "" {
@@ -55,6 +115,10 @@ func GetConfig() *Config {
 		cfg.KeySignature = envSignatureKey
 	}
 
+	if envCallback := os.Getenv("ACCRUAL_CALLBACK_SECRET"); cfg.CallbackSecret == callbackSecDefault && envCallback != "" {
+		cfg.CallbackSecret = envCallback
+	}
+
 	if envRunAddr := os.Getenv("RUN_ADDRESS"); cfg.Address == addressDefault && envRunAddr != "" {
 		cfg.Address = envRunAddr
 	}
@@ -67,6 +131,103 @@ func GetConfig() *Config {
 		cfg.AccrualSystemAddress = envaSysA
 	}
 
+	if envRate := os.Getenv("ACCRUAL_RPS"); cfg.RequestRate == requestRateDefault && envRate != "" {
+		if v, err := strconv.ParseFloat(envRate, 64); err == nil {
+			cfg.RequestRate = v
+		}
+	}
+
+	if envClaim := os.Getenv("ACCRUAL_CLAIM_LIMIT"); cfg.ClaimLimit == claimLimitDefault && envClaim != "" {
+		if v, err := strconv.ParseInt(envClaim, 10, 64); err == nil {
+			cfg.ClaimLimit = v
+		}
+	}
+
+	if envBatch := os.Getenv("ACCRUAL_BATCH_SIZE"); cfg.BatchSize == batchSizeDefault && envBatch != "" {
+		if v, err := strconv.ParseInt(envBatch, 10, 64); err == nil {
+			cfg.BatchSize = v
+		}
+	}
+
+	if envInterval := os.Getenv("ACCRUAL_BATCH_INTERVAL"); cfg.BatchIntervalMs == batchIntervalDef && envInterval != "" {
+		if v, err := strconv.ParseInt(envInterval, 10, 64); err == nil {
+			cfg.BatchIntervalMs = v
+		}
+	}
+
+	if envProviders := os.Getenv("ACCRUAL_PROVIDERS"); cfg.ProvidersFile == providersFileDef && envProviders != "" {
+		cfg.ProvidersFile = envProviders
+	}
+
+	if envNotify := os.Getenv("ACCRUAL_NOTIFY"); cfg.Notify == notifyDefault && envNotify != "" {
+		cfg.Notify = envNotify
+	}
+
+	if envDebounce := os.Getenv("ACCRUAL_NOTIFY_DEBOUNCE"); cfg.NotifyDebounceMs == notifyDebounceDef && envDebounce != "" {
+		if v, err := strconv.ParseInt(envDebounce, 10, 64); err == nil {
+			cfg.NotifyDebounceMs = v
+		}
+	}
+
+	if envLease := os.Getenv("ACCRUAL_LEASE"); cfg.LeaseSec == leaseSecDefault && envLease != "" {
+		if v, err := strconv.ParseInt(envLease, 10, 64); err == nil {
+			cfg.LeaseSec = v
+		}
+	}
+
+	if envBase := os.Getenv("ACCRUAL_BACKOFF_BASE"); cfg.BackoffBaseSec == backoffBaseDefault && envBase != "" {
+		if v, err := strconv.ParseInt(envBase, 10, 64); err == nil {
+			cfg.BackoffBaseSec = v
+		}
+	}
+
+	if envMax := os.Getenv("ACCRUAL_BACKOFF_MAX"); cfg.BackoffMaxSec == backoffMaxDefault && envMax != "" {
+		if v, err := strconv.ParseInt(envMax, 10, 64); err == nil {
+			cfg.BackoffMaxSec = v
+		}
+	}
+
+	if envMaxAge := os.Getenv("ACCRUAL_MAX_AGE"); cfg.MaxAgeSec == maxAgeDefault && envMaxAge != "" {
+		if v, err := strconv.ParseInt(envMaxAge, 10, 64); err == nil {
+			cfg.MaxAgeSec = v
+		}
+	}
+
+	if envAttempts := os.Getenv("ACCRUAL_MAX_ATTEMPTS"); cfg.MaxAttempts == maxAttemptsDefault && envAttempts != "" {
+		if v, err := strconv.ParseInt(envAttempts, 10, 64); err == nil {
+			cfg.MaxAttempts = v
+		}
+	}
+
+	if envFailures := os.Getenv("ACCRUAL_BREAKER_FAILURES"); cfg.BreakerFailures == breakerFailDefault && envFailures != "" {
+		if v, err := strconv.ParseInt(envFailures, 10, 64); err == nil {
+			cfg.BreakerFailures = v
+		}
+	}
+
+	if envCooldown := os.Getenv("ACCRUAL_BREAKER_COOLDOWN"); cfg.BreakerCooldownSec == breakerCoolDefault && envCooldown != "" {
+		if v, err := strconv.ParseInt(envCooldown, 10, 64); err == nil {
+			cfg.BreakerCooldownSec = v
+		}
+	}
+
+	if envTTL := os.Getenv("IDEMPOTENCY_TTL"); cfg.IdempotencyTTLSec == idempotencyTTLDef && envTTL != "" {
+		if v, err := strconv.ParseInt(envTTL, 10, 64); err == nil {
+			cfg.IdempotencyTTLSec = v
+		}
+	}
+
+	if envMigrate := os.Getenv("MIGRATE"); cfg.Migrate == migrateDefault && envMigrate != "" {
+		if v, err := strconv.ParseBool(envMigrate); err == nil {
+			cfg.Migrate = v
+		}
+	}
+
+	if cfg.Dev {
+		cfg.DatabaseURI = ""
+		cfg.Migrate = false
+	}
+
 	if cfg.Key == "" {
 		b, err := utils.GenerateRandom(defaultKeyLen)
 		if err != nil {
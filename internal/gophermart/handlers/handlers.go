@@ -3,16 +3,26 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/4aleksei/gmart/internal/gophermart/handlers/middleware/httpgzip"
+	"github.com/4aleksei/gmart/internal/gophermart/handlers/middleware/httphmacsha256"
+	"github.com/4aleksei/gmart/internal/gophermart/handlers/middleware/httpidempotency"
 	"github.com/4aleksei/gmart/internal/gophermart/handlers/middleware/httplogs"
 	"github.com/4aleksei/gmart/internal/gophermart/service"
 
+	"github.com/4aleksei/gmart/internal/common/httpclientpool"
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/4aleksei/gmart/internal/common/models"
 
@@ -32,6 +42,7 @@ type (
 		Srv       *http.Server
 		l         *logger.ZapLogger
 		key       string
+		cbKey     string
 		s         *service.HandleService
 		tokenAuth *jwtauth.JWTAuth
 	}
@@ -45,6 +56,16 @@ const (
 	textPlainContentCharset string = "text/plain; charset=utf-8"
 
 	defaultHTTPshutdown int = 10
+
+	signatureHeader string = "HashSHA256"
+
+	idempotencyKeyHeader      string = "Idempotency-Key"
+	idempotencyReplayedHeader string = "Idempotent-Replayed"
+	maxIdempotencyKeyLen      int    = 255
+
+	maxRequestBody int64 = 64 << 10
+
+	debugVarsPrefix string = "accrual_"
 )
 
 var (
@@ -55,6 +76,7 @@ func NewHTTPServer(cfg *config.Config, l *logger.ZapLogger, s *service.HandleSer
 	h := &HandlersServer{
 		cfg:       cfg,
 		key:       cfg.Key,
+		cbKey:     cfg.CallbackSecret,
 		l:         l,
 		s:         s,
 		tokenAuth: jwtauth.New("HS256", []byte(cfg.Key), nil),
@@ -150,6 +172,121 @@ func (h *HandlersServer) gzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(gzipfn)
 }
 
+func requestFingerprint(req *http.Request, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(req.Method + " " + req.URL.Path + "\n" + req.Header.Get("Content-Type") + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// withIdempotency replays the stored response of a request sent again with
+// the same Idempotency-Key. Responses with 5xx status are not stored, so
+// such requests may be retried with the same key.
+func (h *HandlersServer) withIdempotency(next http.Handler) http.Handler {
+	idemFn := func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(res, "Bad idempotency key", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := h.testToken(req)
+		if err != nil {
+			http.Error(res, "Unauthorized access!", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxRequestBody))
+		if err != nil {
+			h.l.Logger.Debug("Read body", zap.Error(err))
+			writeBodyError(res, err)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		stored, err := h.s.BeginIdempotent(req.Context(), userID, key, requestFingerprint(req, body))
+		if err != nil {
+			if errors.Is(err, service.ErrIdempotencyMismatch) || errors.Is(err, service.ErrIdempotencyInProgress) {
+				h.l.Logger.Debug("idempotency key conflict", zap.String("key", key), zap.Error(err))
+				http.Error(res, err.Error(), http.StatusConflict)
+			} else {
+				h.l.Logger.Debug("idempotency key", zap.Error(err))
+				res.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		if stored != nil {
+			h.l.Logger.Debug("idempotent replay", zap.String("key", key), zap.Int("status", stored.StatusCode))
+			if stored.ContentType != "" {
+				res.Header().Set("Content-Type", stored.ContentType)
+			}
+			res.Header().Set(idempotencyReplayedHeader, "true")
+			res.WriteHeader(stored.StatusCode)
+			if _, err := res.Write(stored.Response); err != nil {
+				h.l.Logger.Debug("error writing response", zap.Error(err))
+			}
+			return
+		}
+
+		rw := httpidempotency.NewResponseWriter(res)
+		next.ServeHTTP(rw, req)
+
+		ctx := context.WithoutCancel(req.Context())
+		if rw.GetStatus() >= http.StatusInternalServerError {
+			err = h.s.AbortIdempotent(ctx, userID, key)
+		} else {
+			err = h.s.CompleteIdempotent(ctx, userID, key, rw.GetStatus(), rw.Header().Get("Content-Type"), rw.GetBody())
+		}
+		if err != nil {
+			h.l.Logger.Error("idempotency key store", zap.String("key", key), zap.Error(err))
+		}
+	}
+	return http.HandlerFunc(idemFn)
+}
+
+func writeBodyError(res http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(res, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(res, "Error reading request body", http.StatusInternalServerError)
+}
+
+// withSignature checks the HMAC-SHA256 of the request body sent by the
+// accrual system in the HashSHA256 header.
+func (h *HandlersServer) withSignature(next http.Handler) http.Handler {
+	sigFn := func(res http.ResponseWriter, req *http.Request) {
+		want, err := hex.DecodeString(req.Header.Get(signatureHeader))
+		if err != nil || len(want) == 0 {
+			h.l.Logger.Debug("bad signature header", zap.Error(err))
+			http.Error(res, "Bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		hr := httphmacsha256.NewReader(http.MaxBytesReader(res, req.Body, maxRequestBody), []byte(h.cbKey))
+		body, err := io.ReadAll(hr)
+		if err != nil {
+			h.l.Logger.Debug("Read body", zap.Error(err))
+			writeBodyError(res, err)
+			return
+		}
+		got, err := httphmacsha256.GetSig(hr)
+		if err != nil || !hmac.Equal(got, want) {
+			h.l.Logger.Debug("signature mismatch", zap.Error(err))
+			http.Error(res, "Bad signature", http.StatusUnauthorized)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(res, req)
+	}
+	return http.HandlerFunc(sigFn)
+}
+
 func (h *HandlersServer) newRouter() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(h.withLogging)
@@ -161,24 +298,97 @@ func (h *HandlersServer) newRouter() http.Handler {
 		r.Use(jwtauth.Authenticator(h.tokenAuth))
 		r.Use(middleware.Recoverer)
 
-		r.Post("/api/user/orders", h.mainPagePostOrder)
+		r.With(h.withIdempotency).Post("/api/user/orders", h.mainPagePostOrder)
 		r.Get("/api/user/orders", h.mainPageGetOrders)
+		r.Get("/api/user/orders/{number}", h.mainPageGetOrder)
 
 		r.Get("/api/user/withdrawals", h.mainPageGetWithdrawals)
 
 		r.Get("/api/user/balance", h.mainPageGetBalance)
-		r.Post("/api/user/balance/withdraw", h.mainPagePostWithdraw)
+		r.Get("/api/user/balance/ledger", h.mainPageGetLedger)
+		r.With(h.withIdempotency).Post("/api/user/balance/withdraw", h.mainPagePostWithdraw)
 	})
 
+	if h.cbKey != "" {
+		mux.Group(func(r chi.Router) {
+			r.Use(middleware.Recoverer)
+			r.Use(h.withSignature)
+			r.Post("/internal/accrual/callback", h.accrualCallback)
+		})
+	}
+
 	mux.Group(func(r chi.Router) {
 		r.Use(middleware.Recoverer)
 		r.Get("/", h.mainPage)
+		r.Get("/debug/vars", h.mainPageDebugVars)
+		r.Get("/health", h.mainPageHealth)
 		r.Post("/api/user/register", h.mainPageRegister)
 		r.Post("/api/user/login", h.mainPageLogin)
 	})
 	return mux
 }
 
+var errBadPageParam = errors.New("bad page parameter")
+
+func parsePageTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// parsePageQuery reads limit, cursor, status, from and to query parameters.
+// paged is false when none of them is set, so the full list is returned
+// as before.
+func parsePageQuery(req *http.Request) (*service.PageQuery, bool, error) {
+	q := new(service.PageQuery)
+	vals := req.URL.Query()
+	paged := false
+	if v := vals.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w limit: %w", errBadPageParam, err)
+		}
+		q.Limit = limit
+		paged = true
+	}
+	if v := vals.Get("cursor"); v != "" {
+		q.Cursor = v
+		paged = true
+	}
+	if v := vals.Get("status"); v != "" {
+		q.Status = v
+		paged = true
+	}
+	if v := vals.Get("from"); v != "" {
+		t, err := parsePageTime(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w from: %w", errBadPageParam, err)
+		}
+		q.From = t
+		paged = true
+	}
+	if v := vals.Get("to"); v != "" {
+		t, err := parsePageTime(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w to: %w", errBadPageParam, err)
+		}
+		q.To = t
+		paged = true
+	}
+	return q, paged, nil
+}
+
+func setNextLink(res http.ResponseWriter, req *http.Request, q *service.PageQuery, next string) {
+	if next == "" {
+		return
+	}
+	vals := req.URL.Query()
+	vals.Set("limit", strconv.Itoa(q.Limit))
+	vals.Set("cursor", next)
+	res.Header().Add("Link", "<"+req.URL.Path+"?"+vals.Encode()+">; rel=\"next\"")
+}
+
 func (h *HandlersServer) testToken(req *http.Request) (string, error) {
 	jwt, claims, _ := jwtauth.FromContext(req.Context())
 	if jwt == nil || claims["sub"] == "" {
@@ -322,15 +532,34 @@ func (h *HandlersServer) mainPageGetWithdrawals(res http.ResponseWriter, req *ht
 		return
 	}
 
-	res.Header().Add("Content-Type", applicationJSONContent)
+	q, paged, err := parsePageQuery(req)
+	if err != nil {
+		h.l.Logger.Debug("page query", zap.Error(err))
+		http.Error(res, "Bad page query", http.StatusBadRequest)
+		return
+	}
 
-	val, err := h.s.GetWithdrawals(req.Context(), userID)
+	var val []models.Withdraw
+	var next string
+	if paged {
+		val, next, err = h.s.GetWithdrawalsPage(req.Context(), userID, q)
+	} else {
+		val, err = h.s.GetWithdrawals(req.Context(), userID)
+	}
 	if err != nil {
+		if errors.Is(err, service.ErrBadPageQuery) {
+			h.l.Logger.Debug("page query", zap.Error(err))
+			http.Error(res, "Bad page query", http.StatusBadRequest)
+			return
+		}
 		h.l.Logger.Debug("get withdrawals", zap.Error(err))
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	res.Header().Add("Content-Type", applicationJSONContent)
+	setNextLink(res, req, q, next)
+
 	if len(val) == 0 {
 		h.l.Logger.Debug("no row for user  withdrawals")
 		res.WriteHeader(http.StatusNoContent)
@@ -353,6 +582,44 @@ func (h *HandlersServer) mainPageGetWithdrawals(res http.ResponseWriter, req *ht
 	}
 }
 
+func (h *HandlersServer) mainPageGetLedger(res http.ResponseWriter, req *http.Request) {
+	userID, err := h.testToken(req)
+	if err != nil {
+		http.Error(res, "Unauthorized access!", http.StatusUnauthorized)
+		return
+	}
+
+	res.Header().Add("Content-Type", applicationJSONContent)
+
+	val, err := h.s.GetLedger(req.Context(), userID)
+	if err != nil {
+		h.l.Logger.Debug("get ledger", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(val) == 0 {
+		h.l.Logger.Debug("no row for user ledger")
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var buf bytes.Buffer
+	if errson := models.JSONSEncodeBytes(io.Writer(&buf), val); errson != nil {
+		h.l.Logger.Debug("error encoding response", zap.Error(errson))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := io.WriteString(res, buf.String()); err != nil {
+		h.l.Logger.Debug("error writing response", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
 func (h *HandlersServer) mainPageGetOrders(res http.ResponseWriter, req *http.Request) {
 	userID, err := h.testToken(req)
 	if err != nil {
@@ -360,14 +627,33 @@ func (h *HandlersServer) mainPageGetOrders(res http.ResponseWriter, req *http.Re
 		return
 	}
 
-	val, err := h.s.GetOrders(req.Context(), userID)
+	q, paged, err := parsePageQuery(req)
 	if err != nil {
+		h.l.Logger.Debug("page query", zap.Error(err))
+		http.Error(res, "Bad page query", http.StatusBadRequest)
+		return
+	}
+
+	var val []models.Order
+	var next string
+	if paged {
+		val, next, err = h.s.GetOrdersPage(req.Context(), userID, q)
+	} else {
+		val, err = h.s.GetOrders(req.Context(), userID)
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrBadPageQuery) {
+			h.l.Logger.Debug("page query", zap.Error(err))
+			http.Error(res, "Bad page query", http.StatusBadRequest)
+			return
+		}
 		h.l.Logger.Debug("get orders", zap.Error(err))
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	res.Header().Add("Content-Type", applicationJSONContent)
+	setNextLink(res, req, q, next)
 
 	if len(val) == 0 {
 		h.l.Logger.Debug("no row for user orders")
@@ -391,6 +677,135 @@ func (h *HandlersServer) mainPageGetOrders(res http.ResponseWriter, req *http.Re
 	}
 }
 
+func (h *HandlersServer) mainPageGetOrder(res http.ResponseWriter, req *http.Request) {
+	userID, err := h.testToken(req)
+	if err != nil {
+		http.Error(res, "Unauthorized access!", http.StatusUnauthorized)
+		return
+	}
+
+	val, err := h.s.GetOrder(req.Context(), userID, chi.URLParam(req, "number"))
+	if err != nil {
+		if errors.Is(err, service.ErrBadValue) {
+			h.l.Logger.Debug("order num error: ", zap.Error(err))
+			res.WriteHeader(http.StatusBadRequest)
+		} else if errors.Is(err, service.ErrOrderNotFound) {
+			h.l.Logger.Debug("order not found: ", zap.Error(err))
+			res.WriteHeader(http.StatusNotFound)
+		} else {
+			h.l.Logger.Debug("get order", zap.Error(err))
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res.Header().Add("Content-Type", applicationJSONContent)
+
+	var buf bytes.Buffer
+	if errson := models.JSONSEncodeBytes(io.Writer(&buf), val); errson != nil {
+		h.l.Logger.Debug("error encoding response", zap.Error(errson))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := io.WriteString(res, buf.String()); err != nil {
+		h.l.Logger.Debug("error writing response", zap.Error(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// accrualCallback accepts one order status or an array of them in the
+// format of the accrual system GET /api/orders/{number} response.
+func (h *HandlersServer) accrualCallback(res http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Content-Type") != applicationJSONContent {
+		http.Error(res, "Bad content type", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		h.l.Logger.Debug("Read body", zap.Error(err))
+		http.Error(res, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	var vals []models.OrderAccrual
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &vals)
+	} else {
+		var val models.OrderAccrual
+		err = json.Unmarshal(body, &val)
+		vals = append(vals, val)
+	}
+	if err != nil {
+		h.l.Logger.Debug("cannot decode request JSON body", zap.Error(err))
+		http.Error(res, "Bad callback body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.s.AccrualCallback(req.Context(), vals); err != nil {
+		if errors.Is(err, service.ErrBadCallback) {
+			if errors.Is(err, httpclientpool.ErrAnomaly) {
+				h.l.Logger.Error("ALERT accrual callback anomaly quarantined", zap.Error(err))
+			} else {
+				h.l.Logger.Debug("accrual callback", zap.Error(err))
+			}
+			http.Error(res, "Bad callback body", http.StatusBadRequest)
+		} else {
+			h.l.Logger.Debug("Error accrual callback", zap.Error(err))
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	h.l.Logger.Debug("accrual callback applied", zap.Int("orders", len(vals)))
+	res.WriteHeader(http.StatusOK)
+}
+
+func (h *HandlersServer) mainPageHealth(res http.ResponseWriter, req *http.Request) {
+	val, err := h.s.Health(req.Context())
+	if err != nil {
+		h.l.Logger.Error("health: store unavailable", zap.Error(err))
+	}
+
+	var buf bytes.Buffer
+	if errson := models.JSONSEncodeBytes(io.Writer(&buf), val); errson != nil {
+		h.l.Logger.Debug("error encoding response", zap.Error(errson))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Add("Content-Type", applicationJSONContent)
+	if val.Status == service.HealthUnavailable {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		res.WriteHeader(http.StatusOK)
+	}
+
+	if _, err := io.WriteString(res, buf.String()); err != nil {
+		h.l.Logger.Debug("error writing response", zap.Error(err))
+		return
+	}
+}
+
+// mainPageDebugVars serves only the accrual stats: the whole expvar set has
+// cmdline with the keys and the database URI.
+func (h *HandlersServer) mainPageDebugVars(res http.ResponseWriter, req *http.Request) {
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if strings.HasPrefix(kv.Key, debugVarsPrefix) {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	res.Header().Add("Content-Type", applicationJSONContent)
+	if err := json.NewEncoder(res).Encode(vars); err != nil {
+		h.l.Logger.Debug("error writing response", zap.Error(err))
+	}
+}
+
 func (h *HandlersServer) createToken(usernameID, name string) (string, error) {
 	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub":  usernameID,                       // Subject (user identifier)
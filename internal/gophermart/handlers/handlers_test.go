@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"expvar"
 	"time"
 
 	"io"
@@ -15,6 +19,7 @@ import (
 
 	"github.com/4aleksei/gmart/internal/common/logger"
 	"github.com/4aleksei/gmart/internal/common/store"
+	"github.com/4aleksei/gmart/internal/common/store/memory"
 	"github.com/4aleksei/gmart/internal/common/store/mock"
 	"github.com/4aleksei/gmart/internal/common/store/pg"
 	"github.com/4aleksei/gmart/internal/common/utils"
@@ -879,3 +884,503 @@ func Test_handlers_mainPageGetWithdrawals(t *testing.T) {
 		})
 	}
 }
+
+func Test_handlers_mainPageGetLedger(t *testing.T) {
+	decimal.MarshalJSONWithoutQuotes = true
+	type want struct {
+		contentType string
+		statusCode  int
+		body        string
+		contentEnc  string
+	}
+	type request struct {
+		method      string
+		url         string
+		body        string
+		contentType string
+		contentEnc  string
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stor := mock.NewMockStore(ctrl)
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+
+	passWord := "12345"
+	name := "Vasia"
+	passWordSig := hex.EncodeToString(utils.HashPass([]byte(passWord), cfg.KeySignature))
+	arg := store.User{
+		Name: name,
+	}
+	argRet := store.User{
+		Name:     name,
+		Password: passWordSig,
+		ID:       1,
+	}
+
+	timeNow := time.Now()
+	strTime := timeNow.Format(time.RFC3339Nano)
+	var entries = []store.LedgerEntry{
+		{
+			ID:      2,
+			UserID:  1,
+			Type:    store.LedgerDebit,
+			Amount:  decimal.RequireFromString("751"),
+			OrderID: 2377225624,
+			TimeC:   timeNow,
+		},
+		{
+			ID:      1,
+			UserID:  1,
+			Type:    store.LedgerCredit,
+			Amount:  decimal.RequireFromString("1000"),
+			OrderID: 5062821234567892,
+			TimeC:   timeNow,
+		},
+	}
+
+	stor.EXPECT().
+		GetUser(gomock.Any(), arg).
+		Return(argRet, nil).
+		MaxTimes(5)
+
+	stor.EXPECT().
+		GetLedger(gomock.Any(), uint64(1)).
+		Return(entries, nil).
+		MaxTimes(5)
+
+	serV := service.NewService(stor, cfg, nil)
+
+	h := new(HandlersServer)
+	h.s = serV
+	h.key = cfg.Key
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+	tests := []struct {
+		name string
+		req  request
+		want want
+	}{
+		{name: "Get ledger before login No1", req: request{method: http.MethodGet, url: "/api/user/balance/ledger", body: "", contentType: "text/plain"}, want: want{statusCode: http.StatusUnauthorized, contentType: "", body: ""}},
+		{name: "Login User  No2", req: request{method: http.MethodPost, url: "/api/user/login", body: " {\"login\":\"" + name + "\" , \"password\":\"" + passWord + "\" }  ", contentType: "application/json"}, want: want{statusCode: http.StatusOK, contentType: "", body: ""}},
+		{name: "Get ledger No3", req: request{method: http.MethodGet, url: "/api/user/balance/ledger", body: "", contentType: "text/plain"}, want: want{statusCode: http.StatusOK, contentType: "application/json",
+			body: "[{\"type\": \"DEBIT\", \"amount\": 751, \"order\": \"2377225624\", \"created_at\": \"" + strTime + "\" }, {\"type\": \"CREDIT\", \"amount\": 1000, \"order\": \"5062821234567892\", \"created_at\": \"" + strTime + "\" }]"},
+		},
+	}
+
+	jwt := make([]*http.Cookie, 0)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, respBody := testRequest(t, ts, tt.req.method, tt.req.url, tt.req.body, tt.req.contentType, tt.req.contentEnc, jwt)
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			if tt.want.contentType != "" {
+				assert.Equal(t, tt.want.contentType, resp.Header.Get("Content-Type"))
+			}
+			if tt.want.body != "" {
+				assert.JSONEq(t, tt.want.body, respBody)
+			}
+
+			if len(jwt) == 0 {
+				jwt = append(jwt, resp.Cookies()...)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func Test_handlers_mainPageGetOneOrder(t *testing.T) {
+	decimal.MarshalJSONWithoutQuotes = true
+	type want struct {
+		contentType string
+		statusCode  int
+		body        string
+	}
+	type request struct {
+		method      string
+		url         string
+		body        string
+		contentType string
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stor := mock.NewMockStore(ctrl)
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+
+	passWord := "12345"
+	name := "Vasia"
+	passWordSig := hex.EncodeToString(utils.HashPass([]byte(passWord), cfg.KeySignature))
+	argRet := store.User{
+		Name:     name,
+		Password: passWordSig,
+		ID:       1,
+	}
+
+	timeU := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	timeC := timeU.Add(90 * time.Second)
+	strU := timeU.Format(time.RFC3339Nano)
+	strC := timeC.Format(time.RFC3339Nano)
+
+	stor.EXPECT().
+		GetUser(gomock.Any(), store.User{Name: name}).
+		Return(argRet, nil).
+		MaxTimes(5)
+
+	stor.EXPECT().
+		GetOneOrder(gomock.Any(), uint64(5062821234567892)).
+		Return(store.Order{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("500"), TimeU: timeU, TimeC: timeC}, nil).
+		MaxTimes(5)
+
+	stor.EXPECT().
+		GetOneOrder(gomock.Any(), uint64(5062821234567893)).
+		Return(store.Order{OrderID: 5062821234567893, UserID: 2, Status: "NEW", TimeU: timeU, TimeC: timeU}, nil).
+		MaxTimes(5)
+
+	stor.EXPECT().
+		GetOrderHistory(gomock.Any(), uint64(5062821234567892)).
+		Return([]store.OrderStatus{
+			{OrderID: 5062821234567892, Status: "NEW", Accrual: decimal.Zero, TimeC: timeU},
+			{OrderID: 5062821234567892, Status: "PROCESSED", Accrual: decimal.RequireFromString("500"), TimeC: timeC},
+		}, nil).
+		MaxTimes(5)
+
+	serV := service.NewService(stor, cfg, nil)
+
+	h := new(HandlersServer)
+	h.s = serV
+	h.key = cfg.Key
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+	tests := []struct {
+		name string
+		req  request
+		want want
+	}{
+		{name: "Get Order before login No1", req: request{method: http.MethodGet, url: "/api/user/orders/5062821234567892"}, want: want{statusCode: http.StatusUnauthorized}},
+		{name: "Login User  No2", req: request{method: http.MethodPost, url: "/api/user/login", body: " {\"login\":\"" + name + "\" , \"password\":\"" + passWord + "\" }  ", contentType: "application/json"}, want: want{statusCode: http.StatusOK}},
+		{name: "Get Order No3", req: request{method: http.MethodGet, url: "/api/user/orders/5062821234567892"}, want: want{statusCode: http.StatusOK, contentType: "application/json",
+			body: "{\"number\": \"5062821234567892\", \"status\": \"PROCESSED\", \"accrual\": 500, \"uploaded_at\": \"" + strU + "\", \"history\": [" +
+				"{\"status\": \"NEW\", \"accrual\": 0, \"changed_at\": \"" + strU + "\", \"duration_sec\": 90}," +
+				"{\"status\": \"PROCESSED\", \"accrual\": 500, \"changed_at\": \"" + strC + "\", \"duration_sec\": 0}]}"},
+		},
+		{name: "Get Order of other user No4", req: request{method: http.MethodGet, url: "/api/user/orders/5062821234567893"}, want: want{statusCode: http.StatusNotFound}},
+		{name: "Get Order bad number No5", req: request{method: http.MethodGet, url: "/api/user/orders/abc"}, want: want{statusCode: http.StatusBadRequest}},
+	}
+
+	jwt := make([]*http.Cookie, 0)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, respBody := testRequest(t, ts, tt.req.method, tt.req.url, tt.req.body, tt.req.contentType, "", jwt)
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			if tt.want.contentType != "" {
+				assert.Equal(t, tt.want.contentType, resp.Header.Get("Content-Type"))
+			}
+			if tt.want.body != "" {
+				assert.JSONEq(t, tt.want.body, respBody)
+			}
+
+			if len(jwt) == 0 {
+				jwt = append(jwt, resp.Cookies()...)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func Test_handlers_mainPageGetOrdersPage(t *testing.T) {
+	decimal.MarshalJSONWithoutQuotes = true
+	type want struct {
+		statusCode int
+		body       string
+		link       bool
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stor := mock.NewMockStore(ctrl)
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+
+	passWord := "12345"
+	name := "Vasia"
+	passWordSig := hex.EncodeToString(utils.HashPass([]byte(passWord), cfg.KeySignature))
+	argRet := store.User{
+		Name:     name,
+		Password: passWordSig,
+		ID:       1,
+	}
+
+	timeNow := time.Now()
+	strTime := timeNow.Format(time.RFC3339Nano)
+	var orders = []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("500"), TimeU: timeNow, TimeC: timeNow},
+		{OrderID: 5062821234567893, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("100"), TimeU: timeNow, TimeC: timeNow},
+	}
+
+	stor.EXPECT().
+		GetUser(gomock.Any(), store.User{Name: name}).
+		Return(argRet, nil).
+		MaxTimes(5)
+
+	stor.EXPECT().
+		GetOrdersPage(gomock.Any(), store.PageFilter{UserID: 1, Limit: 2, Status: "PROCESSED"}).
+		Return(orders, nil).
+		Times(1)
+
+	stor.EXPECT().
+		GetOrdersPage(gomock.Any(), store.PageFilter{UserID: 1, Limit: service.DefaultPageLimit + 1, Status: "REGISTERED"}).
+		Return(nil, nil).
+		Times(1)
+
+	serV := service.NewService(stor, cfg, nil)
+
+	h := new(HandlersServer)
+	h.s = serV
+	h.key = cfg.Key
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/api/user/login", " {\"login\":\""+name+"\" , \"password\":\""+passWord+"\" }  ", "application/json", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	jwt := resp.Cookies()
+
+	tests := []struct {
+		name string
+		url  string
+		want want
+	}{
+		{name: "First page No1", url: "/api/user/orders?limit=1&status=PROCESSED", want: want{statusCode: http.StatusOK, link: true,
+			body: "[{\"number\": \"5062821234567892\", \"status\": \"PROCESSED\", \"accrual\": 500, \"uploaded_at\": \"" + strTime + "\" }]"}},
+		{name: "Bad status No2", url: "/api/user/orders?status=DONE", want: want{statusCode: http.StatusBadRequest}},
+		{name: "Registered No5", url: "/api/user/orders?status=REGISTERED", want: want{statusCode: http.StatusNoContent}},
+		{name: "Bad limit No3", url: "/api/user/orders?limit=x", want: want{statusCode: http.StatusBadRequest}},
+		{name: "Bad cursor No4", url: "/api/user/orders?cursor=@@", want: want{statusCode: http.StatusBadRequest}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, respBody := testRequest(t, ts, http.MethodGet, tt.url, "", "", "", jwt)
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			if tt.want.body != "" {
+				assert.JSONEq(t, tt.want.body, respBody)
+			}
+			if tt.want.link {
+				assert.Contains(t, resp.Header.Get("Link"), "rel=\"next\"")
+				assert.Contains(t, resp.Header.Get("Link"), "cursor=")
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func Test_handlers_withIdempotency(t *testing.T) {
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+	stor := memory.New()
+	ctx := context.Background()
+	require.NoError(t, stor.InsertOrder(ctx, store.Order{OrderID: 5062821234567892, UserID: 1, Status: "NEW"}))
+	require.NoError(t, stor.UpdateOrdersBalancesBatch(ctx, []store.Order{
+		{OrderID: 5062821234567892, UserID: 1, Status: "PROCESSED", Accrual: decimal.RequireFromString("1000")},
+	}))
+
+	h := new(HandlersServer)
+	h.s = service.NewService(stor, cfg, nil)
+	h.key = cfg.Key
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+
+	token, err := h.createToken("1", "Vasia")
+	require.NoError(t, err)
+
+	send := func(key, body string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL+"/api/user/balance/withdraw", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", applicationJSONContent)
+		req.Header.Set(idempotencyKeyHeader, key)
+		req.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send("key-1", "{\"order\": \"2377225624\",  \"sum\": 300  }")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(idempotencyReplayedHeader))
+
+	resp = send("key-1", "{\"order\": \"2377225624\",  \"sum\": 300  }")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get(idempotencyReplayedHeader))
+
+	resp = send("key-1", "{\"order\": \"2377225624\",  \"sum\": 400  }")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = send(strings.Repeat("k", maxIdempotencyKeyLen+1), "{\"order\": \"2377225624\",  \"sum\": 300  }")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = send("key-2", strings.Repeat(" ", int(maxRequestBody)+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	b, err := stor.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("700").Equal(b.Accrual))
+}
+
+func Test_handlers_mainPageHealth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stor := mock.NewMockStore(ctrl)
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+
+	gomock.InOrder(
+		stor.EXPECT().Ping(gomock.Any()).Return(nil),
+		stor.EXPECT().Ping(gomock.Any()).Return(errors.New("connection refused")),
+	)
+
+	h := new(HandlersServer)
+	h.s = service.NewService(stor, cfg, nil)
+	h.key = cfg.Key
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/health", "", "", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"ok","store":"ok","accrual":"closed"}`, body)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/health", "", "", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"unavailable","store":"unavailable","accrual":"closed"}`, body)
+}
+
+func Test_handlers_accrualCallback(t *testing.T) {
+	cfg := &config.Config{
+		Key:          "Test",
+		KeySignature: "Test",
+	}
+	stor := memory.New()
+	ctx := context.Background()
+	require.NoError(t, stor.InsertOrder(ctx, store.Order{OrderID: 5062821234567892, UserID: 1, Status: "NEW"}))
+
+	h := new(HandlersServer)
+	h.s = service.NewService(stor, cfg, nil)
+	h.key = cfg.Key
+	h.cbKey = "secret"
+	h.tokenAuth = jwtauth.New("HS256", []byte(cfg.Key), nil)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+
+	sign := func(key, body string) string {
+		m := hmac.New(sha256.New, []byte(key))
+		m.Write([]byte(body))
+		return hex.EncodeToString(m.Sum(nil))
+	}
+	send := func(sig, body string) int {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL+"/internal/accrual/callback", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", applicationJSONContent)
+		if sig != "" {
+			req.Header.Set(signatureHeader, sig)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	processed := `{"order":"5062821234567892","status":"PROCESSED","accrual":500}`
+	large := strings.Repeat(" ", int(maxRequestBody)+1)
+	tests := []struct {
+		name   string
+		sig    string
+		body   string
+		status int
+	}{
+		{name: "no signature", body: processed, status: http.StatusUnauthorized},
+		{name: "wrong key", sig: sign("other", processed), body: processed, status: http.StatusUnauthorized},
+		{name: "too large", sig: sign("secret", large), body: large, status: http.StatusRequestEntityTooLarge},
+		{name: "unknown status", sig: sign("secret", `{"order":"5062821234567892","status":"DONE"}`), body: `{"order":"5062821234567892","status":"DONE"}`, status: http.StatusBadRequest},
+		{name: "accrual on invalid", sig: sign("secret", `{"order":"5062821234567892","status":"INVALID","accrual":10}`), body: `{"order":"5062821234567892","status":"INVALID","accrual":10}`, status: http.StatusBadRequest},
+		{name: "processing", sig: sign("secret", `[{"order":"5062821234567892","status":"PROCESSING"}]`), body: `[{"order":"5062821234567892","status":"PROCESSING"}]`, status: http.StatusOK},
+		{name: "processed", sig: sign("secret", processed), body: processed, status: http.StatusOK},
+		{name: "processed again", sig: sign("secret", processed), body: processed, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, send(tt.sig, tt.body))
+		})
+	}
+
+	b, err := stor.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, decimal.RequireFromString("500").Equal(b.Accrual))
+
+	anomalies, err := stor.GetAnomalies(ctx, 10)
+	require.NoError(t, err)
+	assert.Len(t, anomalies, 2)
+}
+
+func Test_handlers_mainPageDebugVars(t *testing.T) {
+	expvar.Publish("accrual_test", expvar.Func(func() any { return map[string]int{"done": 1} }))
+
+	h := new(HandlersServer)
+	var errL error
+	h.l, errL = logger.New(logger.Config{Level: "debug"})
+	require.NoError(t, errL)
+	h.tokenAuth = jwtauth.New("HS256", []byte("Test"), nil)
+
+	ts := httptest.NewServer(h.newRouter())
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/debug/vars", "", "", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"accrual_test":{"done":1}}`, body)
+	assert.NotContains(t, body, "cmdline")
+}
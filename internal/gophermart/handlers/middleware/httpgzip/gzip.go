@@ -7,8 +7,10 @@ import (
 )
 
 type compressWriter struct {
-	w  http.ResponseWriter
-	zw *gzip.Writer
+	w           http.ResponseWriter
+	zw          *gzip.Writer
+	wroteHeader bool
+	compress    bool
 }
 
 func NewCompressWriter(w http.ResponseWriter) *compressWriter {
@@ -23,19 +25,35 @@ func (c *compressWriter) Header() http.Header {
 }
 
 func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.compress {
+		return c.w.Write(p)
+	}
 	return c.zw.Write(p)
 }
 
 const unsuccessStatusCode int = 300
 
+// WriteHeader compresses only successful responses, error bodies are
+// sent as is.
 func (c *compressWriter) WriteHeader(statusCode int) {
-	if statusCode < unsuccessStatusCode {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	if statusCode < unsuccessStatusCode && statusCode != http.StatusNoContent {
+		c.compress = true
 		c.w.Header().Set("Content-Encoding", "gzip")
 	}
 	c.w.WriteHeader(statusCode)
 }
 
 func (c *compressWriter) Close() error {
+	if !c.compress {
+		return nil
+	}
 	return c.zw.Close()
 }
 
@@ -0,0 +1,60 @@
+package httpgzip
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		compress bool
+	}{
+		{name: "ok", status: http.StatusOK, body: `{"status":"ok"}`, compress: true},
+		{name: "implicit ok", body: `{"status":"ok"}`, compress: true},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "bad request", status: http.StatusBadRequest, body: "Bad request\n"},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: `{"status":"unavailable"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cw := NewCompressWriter(rec)
+			if tt.status != 0 {
+				cw.WriteHeader(tt.status)
+				cw.WriteHeader(http.StatusInternalServerError)
+			}
+			if tt.body != "" {
+				_, err := cw.Write([]byte(tt.body))
+				require.NoError(t, err)
+			}
+			require.NoError(t, cw.Close())
+
+			want := tt.status
+			if want == 0 {
+				want = http.StatusOK
+			}
+			assert.Equal(t, want, rec.Code)
+
+			if !tt.compress {
+				assert.Empty(t, rec.Header().Get("Content-Encoding"))
+				assert.Equal(t, tt.body, rec.Body.String())
+				return
+			}
+			assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+			zr, err := gzip.NewReader(rec.Body)
+			require.NoError(t, err)
+			got, err := io.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(got))
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package httpidempotency
+
+import (
+	"bytes"
+	"net/http"
+)
+
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func NewResponseWriter(w http.ResponseWriter) *recordingResponseWriter {
+	return &recordingResponseWriter{
+		ResponseWriter: w,
+	}
+}
+
+func (r *recordingResponseWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recordingResponseWriter) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *recordingResponseWriter) GetStatus() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *recordingResponseWriter) GetBody() []byte {
+	return r.body.Bytes()
+}
@@ -3,13 +3,17 @@ package service
 import (
 	"context"
 
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/4aleksei/gmart/internal/common/models"
+	"github.com/4aleksei/gmart/internal/common/notify"
 	"github.com/4aleksei/gmart/internal/common/store"
 	"github.com/4aleksei/gmart/internal/common/store/pg"
 	"github.com/4aleksei/gmart/internal/common/utils"
@@ -28,13 +32,28 @@ type ServiceStore interface {
 	InsertOrder(context.Context, store.Order) error
 	InsertWithdraw(context.Context, store.Withdraw) error
 	GetOrders(context.Context, uint64) ([]store.Order, error)
+	GetOrdersPage(context.Context, store.PageFilter) ([]store.Order, error)
 
 	GetWithdrawals(context.Context, uint64) ([]store.Withdraw, error)
+	GetWithdrawalsPage(context.Context, store.PageFilter) ([]store.Withdraw, error)
+	GetLedger(context.Context, uint64) ([]store.LedgerEntry, error)
 
 	GetOneOrder(context.Context, uint64) (store.Order, error)
+	GetOrderHistory(context.Context, uint64) ([]store.OrderStatus, error)
 
-	GetOrdersForProcessing(context.Context) ([]store.Order, error)
+	ClaimOrdersForProcessing(context.Context, int, time.Duration) ([]store.Order, error)
+	ReleaseOrders(context.Context, []uint64) error
+	ScheduleOrders(context.Context, []store.OrderSchedule) error
 	UpdateOrdersBalancesBatch(context.Context, []store.Order) error
+	InsertAnomalies(context.Context, []store.Anomaly) error
+
+	ReserveIdempotencyKey(context.Context, store.IdempotencyKey) (store.IdempotencyKey, error)
+	TakeOverIdempotencyKey(context.Context, store.IdempotencyKey) error
+	CompleteIdempotencyKey(context.Context, store.IdempotencyKey) error
+	DeleteIdempotencyKey(context.Context, uint64, string) error
+	DeleteExpiredIdempotencyKeys(context.Context, time.Time) (int, error)
+
+	Ping(context.Context) error
 }
 
 type HandleService struct {
@@ -42,7 +61,7 @@ type HandleService struct {
 	key    string
 	keySig string
 	httpc  *httpclientpool.PoolHandler
-	jid    job.JobID
+	notify notify.Notifier
 }
 
 var (
@@ -60,7 +79,16 @@ var (
 
 	ErrOrderAlreadyLoadedOtherUser = errors.New("error order already loaded other")
 
+	ErrOrderNotFound = errors.New("order not found")
+
+	ErrBadPageQuery = errors.New("bad page query")
+
 	ErrBalanceNotEnough = errors.New("balance not enouth")
+
+	ErrBadCallback = errors.New("bad accrual callback")
+
+	ErrIdempotencyMismatch   = errors.New("idempotency key used with other request")
+	ErrIdempotencyInProgress = errors.New("idempotency key request in progress")
 )
 
 func NewService(s ServiceStore, cfg *config.Config, h *httpclientpool.PoolHandler) *HandleService {
@@ -167,9 +195,27 @@ func (s *HandleService) RegisterOrder(ctx context.Context, userIDStr, orderIDStr
 		}
 		return err
 	}
+	if s.notify != nil {
+		// the poller still finds the order on its next interval
+		_ = s.notify.Notify(ctx)
+	}
 	return nil
 }
 
+// SetNotifier sets the notifier signalled on every registered order.
+func (s *HandleService) SetNotifier(n notify.Notifier) {
+	s.notify = n
+}
+
+// NewOrders returns the channel signalled when orders are registered, nil
+// without a notifier.
+func (s *HandleService) NewOrders() <-chan struct{} {
+	if s.notify == nil {
+		return nil
+	}
+	return s.notify.C()
+}
+
 func (s *HandleService) GetOrders(ctx context.Context, userIDStr string) ([]models.Order, error) {
 	userID, err := strconv.ParseUint(userIDStr, 10, 64)
 	if err != nil {
@@ -186,6 +232,174 @@ func (s *HandleService) GetOrders(ctx context.Context, userIDStr string) ([]mode
 	return valsret, nil
 }
 
+// GetOrder returns one order of the user together with its status timeline.
+// Each step carries the time the order spent in that status; for a pending
+// order the last step is measured up to now.
+func (s *HandleService) GetOrder(ctx context.Context, userIDStr, orderIDStr string) (models.OrderDetail, error) {
+	var detail models.OrderDetail
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return detail, fmt.Errorf("failed %w : %w", ErrBadValueUser, err)
+	}
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 64)
+	if err != nil {
+		return detail, fmt.Errorf("failed %w : %w", ErrBadValue, err)
+	}
+
+	v, err := s.store.GetOneOrder(ctx, orderID)
+	if err != nil {
+		if errors.Is(err, pg.ErrRowNotFound) {
+			return detail, ErrOrderNotFound
+		}
+		return detail, err
+	}
+	if v.UserID != userID {
+		return detail, ErrOrderNotFound
+	}
+
+	hist, err := s.store.GetOrderHistory(ctx, orderID)
+	if err != nil {
+		return detail, err
+	}
+
+	detail.Order = models.Order{OrderID: strconv.FormatUint(v.OrderID, 10), Status: v.Status, Accrual: v.Accrual, Time: v.TimeU}
+	detail.Provider = v.Provider
+	detail.History = make([]models.OrderStatus, len(hist))
+	for i, h := range hist {
+		var end time.Time
+		switch {
+		case i+1 < len(hist):
+			end = hist[i+1].TimeC
+		case h.Status != "PROCESSED" && h.Status != "INVALID":
+			end = time.Now()
+		default:
+			end = h.TimeC
+		}
+		detail.History[i] = models.OrderStatus{Status: h.Status, Accrual: h.Accrual, Time: h.TimeC, DurationSec: end.Sub(h.TimeC).Seconds()}
+	}
+	return detail, nil
+}
+
+const (
+	DefaultPageLimit int = 50
+	MaxPageLimit     int = 1000
+)
+
+type PageQuery struct {
+	Limit  int
+	Cursor string
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+func encodeCursor(t time.Time, id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.UnixNano(), 10) + "." + strconv.FormatUint(id, 10)))
+}
+
+func decodeCursor(c string) (time.Time, uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed %w : %w", ErrBadPageQuery, err)
+	}
+	ts, ids, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("failed %w : cursor", ErrBadPageQuery)
+	}
+	nsec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed %w : %w", ErrBadPageQuery, err)
+	}
+	id, err := strconv.ParseUint(ids, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed %w : %w", ErrBadPageQuery, err)
+	}
+	return time.Unix(0, nsec), id, nil
+}
+
+func (s *HandleService) pageFilter(userIDStr string, q *PageQuery) (store.PageFilter, error) {
+	var f store.PageFilter
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return f, fmt.Errorf("failed %w : %w", ErrBadValueUser, err)
+	}
+	f.UserID = userID
+
+	switch {
+	case q.Limit == 0:
+		q.Limit = DefaultPageLimit
+	case q.Limit < 0 || q.Limit > MaxPageLimit:
+		return f, fmt.Errorf("failed %w : limit %d", ErrBadPageQuery, q.Limit)
+	}
+	f.Limit = q.Limit + 1
+
+	// the values of order_status_type
+	switch q.Status {
+	case "", "NEW", "REGISTERED", "PROCESSING", "INVALID", "PROCESSED":
+		f.Status = q.Status
+	default:
+		return f, fmt.Errorf("failed %w : status %s", ErrBadPageQuery, q.Status)
+	}
+
+	f.From, f.To = q.From, q.To
+	if q.Cursor != "" {
+		f.CursorTime, f.CursorID, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// GetOrdersPage returns one page of the user's orders, newest first, and the
+// cursor of the next page, empty when this page is the last one.
+func (s *HandleService) GetOrdersPage(ctx context.Context, userIDStr string, q *PageQuery) ([]models.Order, string, error) {
+	f, err := s.pageFilter(userIDStr, q)
+	if err != nil {
+		return nil, "", err
+	}
+	vals, err := s.store.GetOrdersPage(ctx, f)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(vals) > q.Limit {
+		vals = vals[:q.Limit]
+		last := vals[len(vals)-1]
+		next = encodeCursor(last.TimeU, last.OrderID)
+	}
+	valsret := make([]models.Order, len(vals))
+	for i, v := range vals {
+		valsret[i] = models.Order{OrderID: strconv.FormatUint(v.OrderID, 10), Status: v.Status, Accrual: v.Accrual, Time: v.TimeU}
+	}
+	return valsret, next, nil
+}
+
+func (s *HandleService) GetWithdrawalsPage(ctx context.Context, userIDStr string, q *PageQuery) ([]models.Withdraw, string, error) {
+	if q.Status != "" {
+		return nil, "", fmt.Errorf("failed %w : status filter is not supported", ErrBadPageQuery)
+	}
+	f, err := s.pageFilter(userIDStr, q)
+	if err != nil {
+		return nil, "", err
+	}
+	vals, err := s.store.GetWithdrawalsPage(ctx, f)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(vals) > q.Limit {
+		vals = vals[:q.Limit]
+		last := vals[len(vals)-1]
+		next = encodeCursor(last.TimeC, last.OrderID)
+	}
+	valsret := make([]models.Withdraw, len(vals))
+	for i, v := range vals {
+		valsret[i] = models.Withdraw{OrderID: strconv.FormatUint(v.OrderID, 10), Sum: v.Sum, TimeC: v.TimeC}
+	}
+	return valsret, next, nil
+}
+
 func (s *HandleService) GetWithdrawals(ctx context.Context, userIDStr string) ([]models.Withdraw, error) {
 	userID, err := strconv.ParseUint(userIDStr, 10, 64)
 	if err != nil {
@@ -202,6 +416,22 @@ func (s *HandleService) GetWithdrawals(ctx context.Context, userIDStr string) ([
 	return valsret, nil
 }
 
+func (s *HandleService) GetLedger(ctx context.Context, userIDStr string) ([]models.LedgerEntry, error) {
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed %w : %w", ErrBadValue, err)
+	}
+	vals, err := s.store.GetLedger(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	valsret := make([]models.LedgerEntry, len(vals))
+	for i, v := range vals {
+		valsret[i] = models.LedgerEntry{Type: v.Type, Amount: v.Amount, OrderID: strconv.FormatUint(v.OrderID, 10), TimeC: v.TimeC}
+	}
+	return valsret, nil
+}
+
 func (s *HandleService) GetBalance(ctx context.Context, userIDStr string) (models.Balance, error) {
 	userID, err := strconv.ParseUint(userIDStr, 10, 64)
 	var valRet models.Balance
@@ -220,16 +450,129 @@ func (s *HandleService) GetBalance(ctx context.Context, userIDStr string) (model
 	return valRet, err
 }
 
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// AccrualState returns the state of the accrual circuit breaker and, when it
+// is open, the time the accrual system is probed again.
+func (s *HandleService) AccrualState() (httpclientpool.BreakerState, time.Time) {
+	if s.httpc == nil {
+		return httpclientpool.StateClosed, time.Time{}
+	}
+	return s.httpc.BreakerState()
+}
+
+// Health reports the store and accrual system state. The service is degraded
+// while the accrual circuit is open and unavailable without the store. The
+// store error is returned for the log only, it is not part of the report.
+func (s *HandleService) Health(ctx context.Context) (models.Health, error) {
+	h := models.Health{Status: HealthOK, Store: HealthOK}
+	state, retryAt := s.AccrualState()
+	h.Accrual = state.String()
+	if state == httpclientpool.StateOpen {
+		h.Status = HealthDegraded
+		h.AccrualRetryAt = &retryAt
+	}
+	err := s.store.Ping(ctx)
+	if err != nil {
+		h.Status = HealthUnavailable
+		h.Store = HealthUnavailable
+	}
+	return h, err
+}
+
+// Idempotency
+
+// abandonedIdempotencyKey is how long a key may stay without a response
+// before it is considered left by a crashed request and taken over.
+const abandonedIdempotencyKey = time.Minute
+
+// BeginIdempotent reserves the key for the request with the given fingerprint.
+// It returns nil when the request has to be executed, or the stored response
+// when the same request was already completed.
+func (s *HandleService) BeginIdempotent(ctx context.Context, userIDStr, key, fingerprint string) (*store.IdempotencyKey, error) {
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed %w : %w", ErrBadValueUser, err)
+	}
+	k := store.IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint}
+	old, err := s.store.ReserveIdempotencyKey(ctx, k)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pg.ErrAlreadyExists) {
+		return nil, err
+	}
+	if old.Fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if old.StatusCode != 0 {
+		return &old, nil
+	}
+	if time.Since(old.TimeC) < abandonedIdempotencyKey {
+		return nil, ErrIdempotencyInProgress
+	}
+
+	// only one retry takes the key over, and not after the request completed
+	if err := s.store.TakeOverIdempotencyKey(ctx, old); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return nil, ErrIdempotencyInProgress
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// CompleteIdempotent stores the response of the request started by BeginIdempotent.
+func (s *HandleService) CompleteIdempotent(ctx context.Context, userIDStr, key string, status int, contentType string, body []byte) error {
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed %w : %w", ErrBadValueUser, err)
+	}
+	return s.store.CompleteIdempotencyKey(ctx, store.IdempotencyKey{UserID: userID, Key: key,
+		StatusCode: status, ContentType: contentType, Response: body})
+}
+
+// AbortIdempotent frees the key so the request can be retried with it.
+func (s *HandleService) AbortIdempotent(ctx context.Context, userIDStr, key string) error {
+	userID, err := strconv.ParseUint(userIDStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed %w : %w", ErrBadValueUser, err)
+	}
+	return s.store.DeleteIdempotencyKey(ctx, userID, key)
+}
+
+// PurgeIdempotencyKeys removes the keys older than ttl with their stored
+// responses, retries with them are executed again.
+func (s *HandleService) PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int, error) {
+	return s.store.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-ttl))
+}
+
 // Accrual Services
 
-func (s *HandleService) GetOrdersForProcess(ctx context.Context) ([]store.Order, error) {
-	vals, err := s.store.GetOrdersForProcessing(ctx)
+func (s *HandleService) ClaimOrdersForProcess(ctx context.Context, limit int, lease time.Duration) ([]store.Order, error) {
+	vals, err := s.store.ClaimOrdersForProcessing(ctx, limit, lease)
 	if err != nil {
 		return nil, err
 	}
 	return vals, nil
 }
 
+func (s *HandleService) ReleaseOrders(ctx context.Context, orders []store.Order) error {
+	ids := make([]uint64, len(orders))
+	for i := range orders {
+		ids[i] = orders[i].OrderID
+	}
+	return s.store.ReleaseOrders(ctx, ids)
+}
+
+func (s *HandleService) ScheduleOrders(ctx context.Context, sched []store.OrderSchedule) error {
+	return s.store.ScheduleOrders(ctx, sched)
+}
+
 func (s *HandleService) UpdateOrdersAndBalances(ctx context.Context, updOrders []store.Order) error {
 	err := s.store.UpdateOrdersBalancesBatch(ctx, updOrders)
 	if err != nil {
@@ -238,55 +581,50 @@ func (s *HandleService) UpdateOrdersAndBalances(ctx context.Context, updOrders [
 	return nil
 }
 
-func (s *HandleService) newJid() job.JobID {
-	s.jid++
-	return s.jid
+// QuarantineAccrual keeps accrual responses that failed validation away
+// from orders and balances.
+func (s *HandleService) QuarantineAccrual(ctx context.Context, anomalies []store.Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	return s.store.InsertAnomalies(ctx, anomalies)
 }
 
-func (s *HandleService) sendRun(ctx context.Context, jobs chan job.Job, orders []store.Order) {
-	defer close(jobs)
-
-	for _, val := range orders {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			id := s.newJid()
-			jobs <- job.Job{ID: id, Value: val}
+// AccrualCallback stores status changes pushed by the accrual system.
+// Values failing validation are quarantined and the whole callback is
+// rejected.
+func (s *HandleService) AccrualCallback(ctx context.Context, vals []models.OrderAccrual) error {
+	updOrders := make([]store.Order, 0, len(vals))
+	var anomalies []store.Anomaly
+	var errAnomaly error
+	for _, v := range vals {
+		orderID, err := strconv.ParseUint(v.OrderID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed %w : %w", ErrBadCallback, err)
 		}
+		if err := httpclientpool.ValidateAccrual(v.OrderID, v); err != nil {
+			payload, _ := json.Marshal(v)
+			anomalies = append(anomalies, store.Anomaly{OrderID: orderID, Provider: "callback",
+				Reason: err.Error(), Payload: payload})
+			errAnomaly = errors.Join(errAnomaly, err)
+			continue
+		}
+		updOrders = append(updOrders, store.Order{OrderID: orderID, Status: v.Status, Accrual: v.Accrual})
 	}
-}
-
-func (s *HandleService) SendOrdersToAccrual(ctx context.Context, orders []store.Order) (a map[uint64]store.Order, b int, c error) {
-	wg := &sync.WaitGroup{}
-	jobs := make(chan job.Job, s.httpc.WorkerCount*2)
-	results := make(chan job.Result, s.httpc.WorkerCount*2)
-
-	go s.sendRun(ctx, jobs, orders)
-
-	s.httpc.StartPool(ctx, jobs, results, wg)
-
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-	var waitSec int
-	resOrders := make(map[uint64]store.Order)
-	for res := range results {
-		select {
-		case <-ctx.Done():
-			return nil, 0, ctx.Err()
-		default:
-			if res.Err == nil {
-				if res.Result == httpclientpool.HTTPSuccessCode {
-					resOrders[res.Value.OrderID] = res.Value
-				} else if res.Result == httpclientpool.HTTPRetryCode {
-					if res.WaitSec > waitSec {
-						waitSec = res.WaitSec
-					}
-				}
-			}
+	if errAnomaly != nil {
+		if err := s.QuarantineAccrual(ctx, anomalies); err != nil {
+			errAnomaly = errors.Join(errAnomaly, err)
 		}
+		return fmt.Errorf("failed %w : %w", ErrBadCallback, errAnomaly)
+	}
+	if len(updOrders) == 0 {
+		return nil
 	}
-	return resOrders, waitSec, nil
+	return s.UpdateOrdersAndBalances(ctx, updOrders)
+}
+
+// StreamOrdersToAccrual polls the accrual system for the orders and streams
+// one result per order as soon as it is ready, see httpclientpool.Pool.Stream.
+func (s *HandleService) StreamOrdersToAccrual(ctx context.Context, orders []store.Order) <-chan job.Result[httpclientpool.OrderResult] {
+	return s.httpc.StreamOrders(ctx, orders)
 }
@@ -0,0 +1,9 @@
+-- +goose Up
+
+-- NOT VALID: balances overdrawn by the old read-then-decrement withdrawal
+-- must not stop the migration, new writes are checked.
+ALTER TABLE balances ADD CONSTRAINT balances_current_check CHECK (current >= 0) NOT VALID;
+
+
+-- +goose Down
+ALTER TABLE balances DROP CONSTRAINT balances_current_check;
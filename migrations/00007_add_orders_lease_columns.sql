@@ -0,0 +1,15 @@
+-- +goose Up
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_attempt_at timestamptz not null DEFAULT NOW();
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts integer not null DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS leased_until timestamptz;
+
+CREATE INDEX IF NOT EXISTS orders_processing_idx ON orders (next_attempt_at)
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING');
+
+
+-- +goose Down
+DROP INDEX IF EXISTS orders_processing_idx;
+ALTER TABLE orders DROP COLUMN leased_until;
+ALTER TABLE orders DROP COLUMN attempts;
+ALTER TABLE orders DROP COLUMN next_attempt_at;
@@ -0,0 +1,9 @@
+-- +goose Up
+
+CREATE INDEX IF NOT EXISTS orders_user_uploaded_idx ON orders (user_id, uploaded_at DESC, order_id DESC);
+CREATE INDEX IF NOT EXISTS withdrawals_user_processed_idx ON withdrawals (user_id, processed_at DESC, order_id DESC);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS withdrawals_user_processed_idx;
+DROP INDEX IF EXISTS orders_user_uploaded_idx;
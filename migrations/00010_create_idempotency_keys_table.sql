@@ -0,0 +1,16 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id bigint not null,
+    key varchar(255) not null,
+    fingerprint varchar(64) not null,
+    status_code integer not null DEFAULT 0,
+    content_type varchar(128) not null DEFAULT '',
+    response bytea,
+    created_at timestamptz not null DEFAULT NOW(),
+    PRIMARY KEY (user_id, key)
+);
+
+
+-- +goose Down
+DROP TABLE idempotency_keys;
@@ -0,0 +1,14 @@
+-- +goose Up
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stale_at timestamptz;
+
+DROP INDEX IF EXISTS orders_processing_idx;
+CREATE INDEX IF NOT EXISTS orders_processing_idx ON orders (next_attempt_at)
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND stale_at IS NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS orders_processing_idx;
+CREATE INDEX IF NOT EXISTS orders_processing_idx ON orders (next_attempt_at)
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING');
+ALTER TABLE orders DROP COLUMN stale_at;
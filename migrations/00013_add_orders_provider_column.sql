@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS accrual_provider varchar(64);
+
+
+-- +goose Down
+ALTER TABLE orders DROP COLUMN accrual_provider;
@@ -0,0 +1,19 @@
+-- +goose Up
+
+CREATE TABLE IF NOT EXISTS accrual_anomalies (
+    anomaly_id BIGSERIAL PRIMARY KEY,
+    order_id bigint not null REFERENCES orders (order_id),
+    provider varchar(64),
+    reason text not null,
+    payload bytea,
+    created_at timestamptz not null DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS accrual_anomalies_created_idx ON accrual_anomalies (created_at);
+
+ALTER TABLE orders ADD CONSTRAINT orders_accrual_check CHECK (accrual >= 0) NOT VALID;
+
+
+-- +goose Down
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_accrual_check;
+DROP TABLE IF EXISTS accrual_anomalies;
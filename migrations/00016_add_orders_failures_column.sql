@@ -0,0 +1,7 @@
+-- +goose Up
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS failures integer not null DEFAULT 0;
+
+
+-- +goose Down
+ALTER TABLE orders DROP COLUMN failures;